@@ -0,0 +1,226 @@
+package main
+
+import (
+	"log"
+	"nas-os/backend/handlers"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// getEnv returns the value of an environment variable or a fallback
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getEnvBool parses a boolean environment variable, using fallback when unset
+func getEnvBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q", key, value)
+		return fallback
+	}
+	return parsed
+}
+
+// loadMailer returns an SMTP mailer when NAS_SMTP_HOST is set and a
+// LogMailer otherwise
+func loadMailer() handlers.Mailer {
+	host := os.Getenv("NAS_SMTP_HOST")
+	if host == "" {
+		return handlers.LogMailer{}
+	}
+
+	port, err := strconv.Atoi(getEnv("NAS_SMTP_PORT", "587"))
+	if err != nil {
+		log.Printf("Ignoring invalid NAS_SMTP_PORT, using 587")
+		port = 587
+	}
+
+	return handlers.SMTPMailer{
+		Host:     host,
+		Port:     port,
+		Username: os.Getenv("NAS_SMTP_USERNAME"),
+		Password: os.Getenv("NAS_SMTP_PASSWORD"),
+		From:     getEnv("NAS_SMTP_FROM", "nas-os@localhost"),
+	}
+}
+
+// loadTrustedProxies reads NAS_TRUSTED_PROXIES, a comma-separated list of
+// addresses or CIDR ranges of reverse proxies. None are trusted by default,
+// so client addresses come from the connection itself.
+func loadTrustedProxies() []string {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("NAS_TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
+// loadLDAPConfig reads LDAP settings; ok is false when NAS_LDAP_URL is unset
+func loadLDAPConfig() (config handlers.LDAPConfig, ok bool) {
+	url := os.Getenv("NAS_LDAP_URL")
+	if url == "" {
+		return config, false
+	}
+
+	config = handlers.LDAPConfig{
+		URL:                url,
+		StartTLS:           getEnvBool("NAS_LDAP_STARTTLS", false),
+		InsecureSkipVerify: getEnvBool("NAS_LDAP_INSECURE_SKIP_VERIFY", false),
+		BindDN:             os.Getenv("NAS_LDAP_BIND_DN"),
+		BindPassword:       os.Getenv("NAS_LDAP_BIND_PASSWORD"),
+		BaseDN:             os.Getenv("NAS_LDAP_BASE_DN"),
+		UserFilter:         os.Getenv("NAS_LDAP_USER_FILTER"),
+		EmailAttribute:     os.Getenv("NAS_LDAP_EMAIL_ATTRIBUTE"),
+		GroupAttribute:     os.Getenv("NAS_LDAP_GROUP_ATTRIBUTE"),
+		GroupBaseDN:        os.Getenv("NAS_LDAP_GROUP_BASE_DN"),
+		GroupFilter:        os.Getenv("NAS_LDAP_GROUP_FILTER"),
+		DefaultRole:        os.Getenv("NAS_LDAP_DEFAULT_ROLE"),
+		Provision:          getEnvBool("NAS_LDAP_PROVISION", false),
+	}
+
+	// NAS_LDAP_GROUP_ROLES is a ;-separated list of "<group DN>=><role>"
+	for _, pair := range strings.Split(os.Getenv("NAS_LDAP_GROUP_ROLES"), ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		group, role, found := strings.Cut(pair, "=>")
+		if !found {
+			log.Printf("Ignoring invalid LDAP group mapping %q", pair)
+			continue
+		}
+		config.GroupRoles = append(config.GroupRoles, handlers.LDAPGroupRole{
+			Group: strings.TrimSpace(group),
+			Role:  strings.TrimSpace(role),
+		})
+	}
+
+	return config, true
+}
+
+// loadOIDCConfig reads single sign-on settings; ok is false when
+// NAS_OIDC_ISSUER is unset
+func loadOIDCConfig() (config handlers.OIDCConfig, ok bool) {
+	issuer := os.Getenv("NAS_OIDC_ISSUER")
+	if issuer == "" {
+		return config, false
+	}
+
+	config = handlers.OIDCConfig{
+		Issuer:        issuer,
+		ClientID:      os.Getenv("NAS_OIDC_CLIENT_ID"),
+		ClientSecret:  os.Getenv("NAS_OIDC_CLIENT_SECRET"),
+		RedirectURL:   getEnv("NAS_OIDC_REDIRECT_URL", "http://localhost:8080/api/v1/auth/oidc/callback"),
+		UsernameClaim: os.Getenv("NAS_OIDC_USERNAME_CLAIM"),
+		RoleClaim:     os.Getenv("NAS_OIDC_ROLE_CLAIM"),
+		DefaultRole:   os.Getenv("NAS_OIDC_DEFAULT_ROLE"),
+		Provision:     getEnvBool("NAS_OIDC_PROVISION", false),
+		FrontendURL:   os.Getenv("NAS_OIDC_FRONTEND_URL"),
+	}
+	if scopes := os.Getenv("NAS_OIDC_SCOPES"); scopes != "" {
+		config.Scopes = strings.Fields(scopes)
+	}
+
+	// NAS_OIDC_CLAIM_ROLES is a ;-separated list of "<claim value>=><role>"
+	for _, pair := range strings.Split(os.Getenv("NAS_OIDC_CLAIM_ROLES"), ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		value, role, found := strings.Cut(pair, "=>")
+		if !found {
+			log.Printf("Ignoring invalid OIDC role mapping %q", pair)
+			continue
+		}
+		config.ClaimRoles = append(config.ClaimRoles, handlers.OIDCClaimRole{
+			Value: strings.TrimSpace(value),
+			Role:  strings.TrimSpace(role),
+		})
+	}
+
+	return config, true
+}
+
+// loadStorageRoots reads NAS_STORAGE_ROOTS, a ;-separated list of volumes
+// given either as "<name>=<path>" or as a bare path named after its last
+// element
+func loadStorageRoots() []handlers.StorageRoot {
+	var roots []handlers.StorageRoot
+	for _, entry := range strings.Split(getEnv("NAS_STORAGE_ROOTS", "/Users/Shared"), ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, path, found := strings.Cut(entry, "=")
+		if !found {
+			name, path = "", entry
+		}
+		roots = append(roots, handlers.StorageRoot{
+			Name: strings.TrimSpace(name),
+			Path: strings.TrimSpace(path),
+		})
+	}
+	return roots
+}
+
+// loadTrashPolicy reads NAS_TRASH_RETENTION_DAYS (default 30) and
+// NAS_TRASH_MAX_USAGE, the volume usage percentage above which the oldest
+// items are purged (default 90); either may be 0 to disable that rule
+func loadTrashPolicy() handlers.TrashPolicy {
+	days, err := strconv.Atoi(getEnv("NAS_TRASH_RETENTION_DAYS", "30"))
+	if err != nil || days < 0 {
+		log.Printf("Ignoring invalid NAS_TRASH_RETENTION_DAYS, using 30")
+		days = 30
+	}
+	usage, err := strconv.ParseFloat(getEnv("NAS_TRASH_MAX_USAGE", "90"), 64)
+	if err != nil || usage < 0 {
+		log.Printf("Ignoring invalid NAS_TRASH_MAX_USAGE, using 90")
+		usage = 90
+	}
+
+	return handlers.TrashPolicy{
+		MaxAge:   time.Duration(days) * 24 * time.Hour,
+		MaxUsage: usage,
+	}
+}
+
+// loadVersionPolicy reads NAS_VERSIONS_MAX, the number of earlier versions
+// kept per file (0 disables versioning), and NAS_VERSIONS_RETENTION_DAYS
+func loadVersionPolicy() handlers.VersionPolicy {
+	count, err := strconv.Atoi(getEnv("NAS_VERSIONS_MAX", "10"))
+	if err != nil || count < 0 {
+		log.Printf("Ignoring invalid NAS_VERSIONS_MAX, using 10")
+		count = 10
+	}
+	days, err := strconv.Atoi(getEnv("NAS_VERSIONS_RETENTION_DAYS", "30"))
+	if err != nil || days < 0 {
+		log.Printf("Ignoring invalid NAS_VERSIONS_RETENTION_DAYS, using 30")
+		days = 30
+	}
+
+	return handlers.VersionPolicy{
+		MaxVersions: count,
+		MaxAge:      time.Duration(days) * 24 * time.Hour,
+	}
+}
+
+// loadThumbnailCacheSize reads NAS_THUMBNAIL_CACHE_MB, the disk space
+// thumbnails may use before the least recently used are evicted
+func loadThumbnailCacheSize() int64 {
+	mb, err := strconv.ParseInt(getEnv("NAS_THUMBNAIL_CACHE_MB", "512"), 10, 64)
+	if err != nil || mb <= 0 {
+		log.Printf("Ignoring invalid NAS_THUMBNAIL_CACHE_MB, using 512")
+		mb = 512
+	}
+	return mb << 20
+}
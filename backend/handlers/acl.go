@@ -0,0 +1,544 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Folder permissions granted by ACLs
+const (
+	ACLRead   = "read"
+	ACLWrite  = "write"
+	ACLDelete = "delete"
+	ACLShare  = "share"
+)
+
+// ACL principals
+const (
+	ACLKindUser  = "user"
+	ACLKindGroup = "group"
+)
+
+// aclPermissions describes every folder permission
+var aclPermissions = map[string]string{
+	ACLRead:   "List the folder and download its files",
+	ACLWrite:  "Upload files and create folders",
+	ACLDelete: "Delete, move and rename entries",
+	ACLShare:  "Create public share links",
+}
+
+var ErrACLNotFound = errors.New("access control list not found")
+
+var aclsBucket = []byte("acls")
+
+// ACLEntry grants folder permissions to a user or to every member of a
+// group
+type ACLEntry struct {
+	Kind        string   `json:"kind" binding:"required,oneof=user group"`
+	Name        string   `json:"name" binding:"required"`
+	Permissions []string `json:"permissions"`
+}
+
+// FolderACL controls access to a folder and everything below it that has
+// no ACL of its own. Callers not named in the entries get no access. With
+// Inherit set, the entries of the nearest ACL above apply as well. Paths
+// that no ACL covers are open to everyone the role permissions allow.
+type FolderACL struct {
+	Path      string     `json:"path"`
+	Entries   []ACLEntry `json:"entries"`
+	Inherit   bool       `json:"inherit"`
+	Updated   time.Time  `json:"updated"`
+	UpdatedBy string     `json:"updatedBy"`
+}
+
+type ACLRequest struct {
+	Path    string     `json:"path" binding:"required"`
+	Entries []ACLEntry `json:"entries" binding:"dive"`
+	Inherit bool       `json:"inherit"`
+}
+
+// ACLManager caches folder ACLs in memory, keyed by canonical path, since
+// they are consulted for every file operation
+type ACLManager struct {
+	mu   sync.RWMutex
+	db   *bolt.DB
+	acls map[string]FolderACL
+}
+
+var aclManager *ACLManager
+
+// SetACLManager configures the manager used for folder access checks
+func SetACLManager(manager *ACLManager) {
+	aclManager = manager
+}
+
+// NewACLManager loads all folder ACLs from db
+func NewACLManager(db *bolt.DB) (*ACLManager, error) {
+	m := &ACLManager{
+		db:   db,
+		acls: make(map[string]FolderACL),
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(aclsBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(_, v []byte) error {
+			var acl FolderACL
+			if err := json.Unmarshal(v, &acl); err != nil {
+				return err
+			}
+			m.acls[acl.Path] = acl
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Get returns the ACL set on a folder itself
+func (m *ACLManager) Get(path string) (FolderACL, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	acl, exists := m.acls[path]
+	if !exists {
+		return FolderACL{}, ErrACLNotFound
+	}
+	return acl, nil
+}
+
+// List returns all ACLs sorted by path
+func (m *ACLManager) List() []FolderACL {
+	m.mu.RLock()
+	list := make([]FolderACL, 0, len(m.acls))
+	for _, acl := range m.acls {
+		list = append(list, acl)
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	return list
+}
+
+// Governing returns the path of the nearest ACL at or above path, or ""
+// when none applies
+func (m *ACLManager) Governing(path string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for p := path; ; p = filepath.Dir(p) {
+		if _, exists := m.acls[p]; exists {
+			return p
+		}
+		if storage.IsRoot(p) || filepath.Dir(p) == p {
+			return ""
+		}
+	}
+}
+
+// Set creates or replaces the ACL on a folder
+func (m *ACLManager) Set(acl FolderACL) error {
+	data, err := json.Marshal(acl)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err = m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(aclsBucket).Put([]byte(acl.Path), data)
+	})
+	if err != nil {
+		return err
+	}
+	m.acls[acl.Path] = acl
+	return nil
+}
+
+// Delete removes the ACL on a folder, which then inherits again
+func (m *ACLManager) Delete(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.acls[path]; !exists {
+		return ErrACLNotFound
+	}
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(aclsBucket).Delete([]byte(path))
+	})
+	if err != nil {
+		return err
+	}
+	delete(m.acls, path)
+	return nil
+}
+
+// Move carries the ACLs on src and the folders below it over to dst,
+// replacing any ACLs at dst
+func (m *ACLManager) Move(src, dst string) error {
+	if src == dst {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var removed []string
+	moved := make(map[string]FolderACL)
+	for p, acl := range m.acls {
+		if isWithin(dst, p) {
+			removed = append(removed, p)
+		}
+		if isWithin(src, p) {
+			acl.Path = dst + strings.TrimPrefix(p, src)
+			moved[p] = acl
+			removed = append(removed, p)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(aclsBucket)
+		for _, p := range removed {
+			if err := b.Delete([]byte(p)); err != nil {
+				return err
+			}
+		}
+		for _, acl := range moved {
+			data, err := json.Marshal(acl)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(acl.Path), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, p := range removed {
+		delete(m.acls, p)
+	}
+	for _, acl := range moved {
+		m.acls[acl.Path] = acl
+	}
+	return nil
+}
+
+// Forget drops the ACLs on path and the folders below it
+func (m *ACLManager) Forget(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var removed []string
+	for p := range m.acls {
+		if isWithin(path, p) {
+			removed = append(removed, p)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(aclsBucket)
+		for _, p := range removed {
+			if err := b.Delete([]byte(p)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range removed {
+		delete(m.acls, p)
+	}
+	return nil
+}
+
+// RemovePrincipal drops the entries naming a user or group from every ACL
+func (m *ACLManager) RemovePrincipal(kind, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var changed []FolderACL
+	for _, acl := range m.acls {
+		entries := make([]ACLEntry, 0, len(acl.Entries))
+		for _, entry := range acl.Entries {
+			if entry.Kind != kind || entry.Name != name {
+				entries = append(entries, entry)
+			}
+		}
+		if len(entries) < len(acl.Entries) {
+			acl.Entries = entries
+			changed = append(changed, acl)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(aclsBucket)
+		for _, acl := range changed {
+			data, err := json.Marshal(acl)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(acl.Path), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, acl := range changed {
+		m.acls[acl.Path] = acl
+	}
+	return nil
+}
+
+// Permissions returns what user may do at path, a canonical path inside a
+// volume. User admins may do everything everywhere.
+func (m *ACLManager) Permissions(user *User, path string) map[string]bool {
+	all := make(map[string]bool, len(aclPermissions))
+	for perm := range aclPermissions {
+		all[perm] = true
+	}
+	if roleManager.Permissions(user)[PermUsersAdmin] {
+		return all
+	}
+
+	var groups []string
+	if groupManager != nil {
+		for _, group := range groupManager.GroupsFor(user.Username) {
+			groups = append(groups, group.Name)
+		}
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	perms := make(map[string]bool)
+	governed := false
+	for p := path; ; p = filepath.Dir(p) {
+		if acl, exists := m.acls[p]; exists {
+			governed = true
+			for _, entry := range acl.Entries {
+				if entry.Kind == ACLKindUser && entry.Name == user.Username ||
+					entry.Kind == ACLKindGroup && containsString(groups, entry.Name) {
+					for _, perm := range entry.Permissions {
+						perms[perm] = true
+					}
+				}
+			}
+			if !acl.Inherit {
+				break
+			}
+		}
+		if storage.IsRoot(p) || filepath.Dir(p) == p {
+			break
+		}
+	}
+
+	if !governed {
+		return all
+	}
+	return perms
+}
+
+// Allowed reports whether user holds perm at path
+func (m *ACLManager) Allowed(user *User, path, perm string) bool {
+	return m.Permissions(user, path)[perm]
+}
+
+// AllowedTree reports whether user holds perm at path and in every folder
+// below it that has an ACL of its own, as needed to delete or move a
+// whole folder
+func (m *ACLManager) AllowedTree(user *User, path, perm string) bool {
+	if !m.Allowed(user, path, perm) {
+		return false
+	}
+
+	m.mu.RLock()
+	var below []string
+	for p := range m.acls {
+		if p != path && isWithin(path, p) {
+			below = append(below, p)
+		}
+	}
+	m.mu.RUnlock()
+
+	for _, p := range below {
+		if !m.Allowed(user, p, perm) {
+			return false
+		}
+	}
+	return true
+}
+
+// requireAccess replies 403 unless the caller holds perm at path. It
+// reports whether the request may go ahead.
+func requireAccess(c *gin.Context, path, perm string) bool {
+	user := c.MustGet("user").(*User)
+	if aclManager.Allowed(user, path, perm) {
+		return true
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+	return false
+}
+
+// requireTreeAccess is requireAccess for path and every folder below it
+func requireTreeAccess(c *gin.Context, path, perm string) bool {
+	user := c.MustGet("user").(*User)
+	if aclManager.AllowedTree(user, path, perm) {
+		return true
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+	return false
+}
+
+// requireReplaceAccess checks that the caller may delete whatever is at path,
+// since writing there would replace it
+func requireReplaceAccess(c *gin.Context, path string) bool {
+	if _, err := os.Lstat(path); err != nil {
+		return true
+	}
+	return requireTreeAccess(c, path, ACLDelete)
+}
+
+// GetFolderACL describes access to the folder at ?path=: the ACL set on
+// it, if any, the folder whose ACL governs it and what the caller may do
+func GetFolderACL(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	cleanPath, ok := resolveRequestPath(c, c.DefaultQuery("path", storage.Default()))
+	if !ok {
+		return
+	}
+	if !requireAccess(c, cleanPath, ACLRead) {
+		return
+	}
+
+	response := gin.H{
+		"path":        cleanPath,
+		"governedBy":  aclManager.Governing(cleanPath),
+		"permissions": aclManager.Permissions(user, cleanPath),
+	}
+	if acl, err := aclManager.Get(cleanPath); err == nil {
+		response["acl"] = acl
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// GetACLs lists every folder ACL
+func GetACLs(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"acls":        aclManager.List(),
+		"permissions": aclPermissions,
+	})
+}
+
+// SetACL creates or replaces the ACL on a folder
+func SetACL(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	var req ACLRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	cleanPath, ok := resolveRequestPath(c, req.Path)
+	if !ok {
+		return
+	}
+	if info, err := os.Stat(cleanPath); err != nil || !info.IsDir() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ACLs can only be set on existing folders"})
+		return
+	}
+
+	entries := make([]ACLEntry, 0, len(req.Entries))
+	for _, entry := range req.Entries {
+		for _, perm := range entry.Permissions {
+			if _, known := aclPermissions[perm]; !known {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown permission: " + perm})
+				return
+			}
+		}
+
+		switch entry.Kind {
+		case ACLKindUser:
+			principal, err := userStore.GetUser(entry.Name)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown user: " + entry.Name})
+				return
+			}
+			entry.Name = principal.Username
+		case ACLKindGroup:
+			if _, err := groupManager.Get(entry.Name); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown group: " + entry.Name})
+				return
+			}
+		}
+		entry.Permissions = uniqueSorted(entry.Permissions)
+		entries = append(entries, entry)
+	}
+
+	acl := FolderACL{
+		Path:      cleanPath,
+		Entries:   entries,
+		Inherit:   req.Inherit,
+		Updated:   time.Now(),
+		UpdatedBy: user.Username,
+	}
+	if err := aclManager.Set(acl); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save ACL"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"acl": acl})
+}
+
+// DeleteACL removes the ACL on the folder at ?path=
+func DeleteACL(c *gin.Context) {
+	cleanPath, ok := resolveRequestPath(c, c.Query("path"))
+	if !ok {
+		return
+	}
+
+	if err := aclManager.Delete(cleanPath); err != nil {
+		if errors.Is(err, ErrACLNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "ACL not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete ACL"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "ACL deleted successfully"})
+}
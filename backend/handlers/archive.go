@@ -0,0 +1,261 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ArchiveRequest struct {
+	Paths  []string `json:"paths" form:"paths" binding:"required,min=1"`
+	Format string   `json:"format" form:"format" binding:"omitempty,oneof=zip tar.gz"`
+	// Name is the download filename without extension
+	Name string `json:"name" form:"name"`
+}
+
+// archiveEntry is a selected path and the name it gets inside the archive
+type archiveEntry struct {
+	path string
+	name string
+	// within, when set, limits where symlinks below path may point
+	within string
+	// user, when set, leaves out folders and files user may not read
+	user *User
+}
+
+// archiveWriter abstracts over the zip and tar.gz encoders
+type archiveWriter interface {
+	// add writes a file or directory header and, for files, the contents of r
+	add(name string, info fs.FileInfo, r io.Reader) error
+	Close() error
+}
+
+type zipArchive struct {
+	w *zip.Writer
+}
+
+func (a zipArchive) add(name string, info fs.FileInfo, r io.Reader) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+		header.Method = zip.Store
+	} else {
+		header.Method = zip.Deflate
+	}
+
+	w, err := a.w.CreateHeader(header)
+	if err != nil || info.IsDir() {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (a zipArchive) Close() error {
+	return a.w.Close()
+}
+
+type tarGzArchive struct {
+	gz *gzip.Writer
+	w  *tar.Writer
+}
+
+func (a tarGzArchive) add(name string, info fs.FileInfo, r io.Reader) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+
+	if err := a.w.WriteHeader(header); err != nil || info.IsDir() {
+		return err
+	}
+	// Copy exactly the size announced in the header even if the file is
+	// being appended to while we read it
+	_, err = io.CopyN(a.w, r, header.Size)
+	return err
+}
+
+func (a tarGzArchive) Close() error {
+	if err := a.w.Close(); err != nil {
+		return err
+	}
+	return a.gz.Close()
+}
+
+// DownloadArchive streams the selected files and folders as a ZIP or
+// tar.gz built on the fly. Each selection appears at the top level of the
+// archive under its own name, with folders keeping their structure.
+func DownloadArchive(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	var req ArchiveRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Format == "" {
+		req.Format = "zip"
+	}
+
+	// Validate the whole selection up front; once streaming starts errors
+	// can no longer be reported to the client
+	entries := make([]archiveEntry, 0, len(req.Paths))
+	used := make(map[string]bool)
+	for _, p := range req.Paths {
+		resolved, ok := resolveRequestPath(c, p)
+		if !ok {
+			return
+		}
+		if _, err := os.Stat(resolved); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found: " + p})
+			return
+		}
+		if !requireAccess(c, resolved, ACLRead) {
+			return
+		}
+		entries = append(entries, archiveEntry{path: resolved, name: uniqueArchiveName(filepath.Base(resolved), used), user: user})
+	}
+
+	streamArchive(c, entries, req.Name, req.Format)
+}
+
+// streamArchive writes entries to the response as a ZIP or tar.gz named
+// name, defaulting to the entry's own name for a single selection
+func streamArchive(c *gin.Context, entries []archiveEntry, name, format string) {
+	if name == "" {
+		name = "download"
+		if len(entries) == 1 {
+			name = entries[0].name
+		}
+	}
+	name = strings.NewReplacer("/", "_", "\\", "_").Replace(name)
+
+	var archive archiveWriter
+	switch format {
+	case "tar.gz":
+		c.Header("Content-Type", "application/gzip")
+		gz := gzip.NewWriter(c.Writer)
+		archive = tarGzArchive{gz: gz, w: tar.NewWriter(gz)}
+	default:
+		c.Header("Content-Type", "application/zip")
+		archive = zipArchive{w: zip.NewWriter(c.Writer)}
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + "." + format}))
+	c.Status(http.StatusOK)
+
+	for _, entry := range entries {
+		if err := addArchiveTree(archive, entry); err != nil {
+			// The response is already underway. Leaving out the zip central
+			// directory or gzip trailer makes the archive fail to open rather
+			// than appear complete with files missing.
+			log.Printf("Archive download of %s failed: %v", entry.path, err)
+			return
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		log.Printf("Archive download failed: %v", err)
+	}
+}
+
+// addArchiveTree writes entry and, for folders, everything below it.
+// Symlinks are included as the file they point to when that file is inside
+// the storage volumes and skipped otherwise; linked folders are not
+// descended into, which also rules out cycles. Anything entry.user may not
+// read is skipped as well.
+func addArchiveTree(archive archiveWriter, entry archiveEntry) error {
+	return filepath.WalkDir(entry.path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if storage.IsReserved(p) {
+			return fs.SkipDir
+		}
+		if entry.user != nil && p != entry.path && d.IsDir() && !aclManager.Allowed(entry.user, p, ACLRead) {
+			return fs.SkipDir
+		}
+
+		rel, err := filepath.Rel(entry.path, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join(entry.name, filepath.ToSlash(rel))
+
+		if d.Type()&fs.ModeSymlink != 0 {
+			target, _, err := storage.Resolve(p)
+			if err != nil || (entry.within != "" && !isWithin(entry.within, target)) {
+				return nil
+			}
+			if entry.user != nil && !aclManager.Allowed(entry.user, target, ACLRead) {
+				return nil
+			}
+			info, err := os.Stat(target)
+			if err != nil || !info.Mode().IsRegular() {
+				return nil
+			}
+			return addArchiveFile(archive, name, target)
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.IsDir():
+			return archive.add(name, info, nil)
+		case info.Mode().IsRegular():
+			return addArchiveFile(archive, name, p)
+		default:
+			// Sockets, devices and the like have no place in a download
+			return nil
+		}
+	})
+}
+
+func addArchiveFile(archive archiveWriter, name, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return archive.add(name, info, f)
+}
+
+// uniqueArchiveName disambiguates selections that share a base name, e.g.
+// two folders both called "photos", by numbering the later ones
+func uniqueArchiveName(name string, used map[string]bool) string {
+	candidate := name
+	for i := 2; used[candidate]; i++ {
+		ext := filepath.Ext(name)
+		candidate = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	used[candidate] = true
+	return candidate
+}
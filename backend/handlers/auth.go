@@ -3,7 +3,10 @@ package handlers
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"log"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -17,6 +20,35 @@ type User struct {
 	Role     string `json:"role"`
 	Created  time.Time `json:"created"`
 	LastLogin *time.Time `json:"lastLogin,omitempty"`
+	TwoFactorEnabled bool `json:"twoFactorEnabled"`
+	Source   string `json:"source"`
+	// Issuer and Subject bind a single sign-on account to its identity
+	// provider login, which outlives username changes
+	Issuer  string `json:"issuer,omitempty"`
+	Subject string `json:"subject,omitempty"`
+}
+
+// Where a user account is managed
+const (
+	UserSourceLocal = "local"
+	UserSourceLDAP  = "ldap"
+	UserSourceOIDC  = "oidc"
+)
+
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// UpdateUserRequest fields are optional; only those present are changed
+type UpdateUserRequest struct {
+	Email    *string `json:"email" binding:"omitempty,email"`
+	Role     *string `json:"role"`
+	Password *string `json:"password" binding:"omitempty,min=6"`
+}
+
+// UpdateProfileRequest changes the caller's email; the current password is
+// required because reset links are sent to that address
+type UpdateProfileRequest struct {
+	Email    string `json:"email" binding:"required,email"`
+	Password string `json:"password"`
 }
 
 type LoginRequest struct {
@@ -27,36 +59,40 @@ type LoginRequest struct {
 type CreateUserRequest struct {
 	Username string `json:"username" binding:"required"`
 	Email    string `json:"email" binding:"required,email"`
-	Password string `json:"password" binding:"required,min=6"`
+	Password string `json:"password" binding:"required_unless=Source ldap,omitempty,min=6"`
 	Role     string `json:"role"`
+	Source   string `json:"source" binding:"omitempty,oneof=local ldap oidc"`
 }
 
-type Session struct {
-	Token   string    `json:"token"`
-	UserID  int       `json:"userId"`
-	Expires time.Time `json:"expires"`
+var userStore UserStore
+
+// SetUserStore configures the store used for user accounts
+func SetUserStore(store UserStore) {
+	userStore = store
 }
 
-// In-memory storage for demo purposes
-// In production, use a proper database
-var users = make(map[string]*User)
-var sessions = make(map[string]*Session)
-var userCounter = 1
-
-func init() {
-	// Create default admin user
-	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("admin123"), bcrypt.DefaultCost)
-	users["admin"] = &User{
-		ID:       userCounter,
+// EnsureDefaultAdmin creates the default admin account on an empty store
+func EnsureDefaultAdmin(store UserStore) error {
+	existing, err := store.ListUsers()
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return nil
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("admin123"), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	return store.CreateUser(&User{
 		Username: "admin",
 		Email:    "admin@nas-os.local",
 		Role:     "admin",
+		Source:   UserSourceLocal,
 		Created:  time.Now(),
-	}
-	// Store password separately (in production, store in database)
-	userPasswords := make(map[string]string)
-	userPasswords["admin"] = string(hashedPassword)
-	userCounter++
+	}, string(hashedPassword))
 }
 
 // Login authenticates a user and returns a session token
@@ -67,58 +103,107 @@ func Login(c *gin.Context) {
 		return
 	}
 
-	user, exists := users[req.Username]
-	if !exists {
+	if rejectIfLocked(c, req.Username) {
+		return
+	}
+
+	user, err := authenticatePassword(req.Username, req.Password)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCredentials) || errors.Is(err, ErrLDAPInvalidCredentials) {
+			loginLimiter.Fail(req.Username, c.ClientIP())
+		} else {
+			log.Printf("Login for %q failed: %v", req.Username, err)
+		}
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
-	// In production, retrieve hashed password from database
-	// For demo, we'll use a simple check
-	if req.Username == "admin" && req.Password == "admin123" {
-		// Generate session token
-		token, err := generateToken()
+	// Users with 2FA must confirm a code via VerifyLogin first
+	if user.TwoFactorEnabled {
+		challenge, err := newLoginChallenge(user)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 			return
 		}
 
-		// Create session
-		session := &Session{
-			Token:   token,
-			UserID:  user.ID,
-			Expires: time.Now().Add(24 * time.Hour),
+		c.JSON(http.StatusOK, gin.H{
+			"twoFactorRequired": true,
+			"challenge":         challenge,
+		})
+		return
+	}
+
+	completeLogin(c, user)
+}
+
+// authenticatePassword checks a username and password against the local
+// store, falling back to LDAP for directory users when it is configured
+func authenticatePassword(username, password string) (*User, error) {
+	user, err := userStore.GetUser(username)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return nil, err
+	}
+
+	if user != nil && user.Source != UserSourceLDAP {
+		hash, err := userStore.GetPasswordHash(user.Username)
+		if err != nil {
+			return nil, err
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+			return nil, ErrInvalidCredentials
 		}
-		sessions[token] = session
+		return user, nil
+	}
 
-		// Update last login
-		now := time.Now()
-		user.LastLogin = &now
+	if ldapAuthenticator == nil {
+		return nil, ErrInvalidCredentials
+	}
+	return authenticateLDAP(username, password)
+}
 
-		c.JSON(http.StatusOK, gin.H{
-			"token": token,
-			"user":  user,
-		})
+// completeLogin creates a session for an authenticated user and responds
+// with its token
+func completeLogin(c *gin.Context, user *User) {
+	token, err := startSession(c, user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
-	c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+	c.JSON(http.StatusOK, gin.H{
+		"token": token,
+		"user":  user,
+	})
+}
+
+// startSession creates a session for user and records the login time
+func startSession(c *gin.Context, user *User) (string, error) {
+	token, _, err := sessionManager.Create(user, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		return "", err
+	}
+
+	// Only a fully completed login clears earlier failures
+	loginLimiter.Succeed(user.Username)
+
+	// Update last login
+	now := time.Now()
+	user.LastLogin = &now
+	if err := userStore.UpdateUser(user); err != nil {
+		return "", err
+	}
+	return token, nil
 }
 
 // Logout invalidates a session token
 func Logout(c *gin.Context) {
-	token := c.GetHeader("Authorization")
+	token := bearerToken(c)
 	if token == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "No token provided"})
 		return
 	}
 
-	// Remove "Bearer " prefix if present
-	if len(token) > 7 && token[:7] == "Bearer " {
-		token = token[7:]
-	}
-
-	delete(sessions, token)
+	sessionManager.RevokeToken(token)
 	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
 }
 
@@ -130,155 +215,275 @@ func GetCurrentUser(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"user": user})
-}
-
-// GetUsers returns all users (admin only)
-func GetUsers(c *gin.Context) {
-	user, exists := c.Get("user")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
-		return
-	}
-
-	currentUser := user.(*User)
-	if currentUser.Role != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
-		return
+	permissions := []string{}
+	for perm := range roleManager.Permissions(user.(*User)) {
+		if hasPermission(c, perm) {
+			permissions = append(permissions, perm)
+		}
 	}
+	sort.Strings(permissions)
 
-	var userList []User
-	for _, u := range users {
-		userList = append(userList, *u)
+	groups := []string{}
+	for _, group := range groupManager.GroupsFor(user.(*User).Username) {
+		groups = append(groups, group.Name)
 	}
 
-	c.JSON(http.StatusOK, gin.H{"users": userList})
+	c.JSON(http.StatusOK, gin.H{
+		"user":        user,
+		"permissions": permissions,
+		"groups":      groups,
+	})
 }
 
-// CreateUser creates a new user (admin only)
-func CreateUser(c *gin.Context) {
-	user, exists := c.Get("user")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+// GetUsers returns all users
+func GetUsers(c *gin.Context) {
+	userList, err := userStore.ListUsers()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load users"})
 		return
 	}
 
-	currentUser := user.(*User)
-	if currentUser.Role != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
-		return
-	}
+	c.JSON(http.StatusOK, gin.H{"users": userList})
+}
 
+// CreateUser creates a new user
+func CreateUser(c *gin.Context) {
 	var req CreateUserRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Check if user already exists
-	if _, exists := users[req.Username]; exists {
-		c.JSON(http.StatusConflict, gin.H{"error": "Username already exists"})
-		return
-	}
-
 	// Set default role if not provided
 	if req.Role == "" {
 		req.Role = "user"
 	}
-
-	// Hash password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+	if _, err := roleManager.Get(req.Role); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role"})
 		return
 	}
 
+	// Directory and SSO users authenticate externally and have no local password
+	if req.Source == "" {
+		req.Source = UserSourceLocal
+	}
+	// LDAP logins look accounts up by their lowercased name
+	if req.Source == UserSourceLDAP {
+		req.Username = normalizeUsername(req.Username)
+	}
+	var passwordHash string
+	if req.Source == UserSourceLocal {
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+			return
+		}
+		passwordHash = string(hashedPassword)
+	}
+
 	// Create user
 	newUser := &User{
-		ID:       userCounter,
 		Username: req.Username,
 		Email:    req.Email,
 		Role:     req.Role,
+		Source:   req.Source,
 		Created:  time.Now(),
 	}
-	users[req.Username] = newUser
-	userCounter++
-
-	// Store password (in production, store in database)
-	_ = hashedPassword // Would store this in database
+	if err := userStore.CreateUser(newUser, passwordHash); err != nil {
+		if errors.Is(err, ErrUserExists) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Username already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
 
 	c.JSON(http.StatusCreated, gin.H{"user": newUser})
 }
 
-// DeleteUser deletes a user (admin only)
-func DeleteUser(c *gin.Context) {
-	user, exists := c.Get("user")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+// UpdateUser changes a user's email, role or password
+func UpdateUser(c *gin.Context) {
+	var req UpdateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := userStore.GetUser(c.Param("username"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if req.Role != nil {
+		if _, err := roleManager.Get(*req.Role); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role"})
+			return
+		}
+		if user.Username == "admin" && *req.Role != "admin" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot change role of admin user"})
+			return
+		}
+		user.Role = *req.Role
+	}
+	if req.Email != nil {
+		user.Email = *req.Email
+	}
+
+	if req.Password != nil {
+		if user.Source != UserSourceLocal {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Password is managed by an external directory"})
+			return
+		}
+		if err := setPassword(user, *req.Password); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
+			return
+		}
+		sessionManager.RevokeUser(user.ID)
+	}
+
+	if err := userStore.UpdateUser(user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+// UpdateCurrentUser lets users change their own email address
+func UpdateCurrentUser(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	var req UpdateProfileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Email == user.Email {
+		c.JSON(http.StatusOK, gin.H{"user": user})
+		return
+	}
+
+	if user.Source != UserSourceLocal {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Email is managed by an external directory"})
 		return
 	}
 
-	currentUser := user.(*User)
-	if currentUser.Role != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+	if rejectIfLocked(c, user.Username) {
 		return
 	}
 
+	hash, err := userStore.GetPasswordHash(user.Username)
+	if err != nil || bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)) != nil {
+		loginLimiter.Fail(user.Username, c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+
+	if err := userStore.SetEmail(user.Username, req.Email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		return
+	}
+	user.Email = req.Email
+
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+// DeleteUser deletes a user along with their sessions, API tokens, group
+// memberships, folder ACL entries and quotas
+func DeleteUser(c *gin.Context) {
 	username := c.Param("username")
 	if username == "admin" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot delete admin user"})
 		return
 	}
 
-	if _, exists := users[username]; !exists {
+	target, err := userStore.GetUser(username)
+	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
 
-	delete(users, username)
+	if err := userStore.DeleteUser(username); err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user"})
+		return
+	}
+	sessionManager.RevokeUser(target.ID)
+	if err := apiTokenStore.RevokeUser(target.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API tokens"})
+		return
+	}
+	if err := groupManager.RemoveUser(target.Username); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update groups"})
+		return
+	}
+	// A user created later under the same name must not inherit these
+	if err := aclManager.RemovePrincipal(ACLKindUser, target.Username); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update folder ACLs"})
+		return
+	}
+	if err := quotaManager.DeletePrincipal(QuotaKindUser, target.Username); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete quotas"})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": "User deleted successfully"})
 }
 
 // AuthMiddleware validates session tokens
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		token := c.GetHeader("Authorization")
+		token := bearerToken(c)
 		if token == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "No token provided"})
 			c.Abort()
 			return
 		}
 
-		// Remove "Bearer " prefix if present
-		if len(token) > 7 && token[:7] == "Bearer " {
-			token = token[7:]
-		}
-
-		session, exists := sessions[token]
-		if !exists {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-			c.Abort()
-			return
-		}
-
-		// Check if session is expired
-		if time.Now().After(session.Expires) {
-			delete(sessions, token)
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Token expired"})
-			c.Abort()
-			return
-		}
-
-		// Find user by ID
-		var user *User
-		for _, u := range users {
-			if u.ID == session.UserID {
-				user = u
-				break
+		// Unknown tokens are not counted as failed logins: they are far too
+		// long to guess, and stale ones left in a browser after the session
+		// was reaped would otherwise lock out everyone behind the same
+		// address
+
+		// API tokens and session tokens share the Authorization header
+		var userID int
+		if isAPIToken(token) {
+			apiToken, err := apiTokenStore.Validate(token)
+			if errors.Is(err, ErrAPITokenExpired) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Token expired"})
+				c.Abort()
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+				c.Abort()
+				return
 			}
+			userID = apiToken.UserID
+			c.Set("apiToken", apiToken)
+		} else {
+			session, err := sessionManager.Validate(token)
+			if errors.Is(err, ErrSessionExpired) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Token expired"})
+				c.Abort()
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+				c.Abort()
+				return
+			}
+			userID = session.UserID
+			c.Set("session", session)
 		}
 
-		if user == nil {
+		user, err := userStore.GetUserByID(userID)
+		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
 			c.Abort()
 			return
@@ -289,6 +494,17 @@ func AuthMiddleware() gin.HandlerFunc {
 	}
 }
 
+// bearerToken extracts the token from the Authorization header
+func bearerToken(c *gin.Context) string {
+	token := c.GetHeader("Authorization")
+
+	// Remove "Bearer " prefix if present
+	if len(token) > 7 && token[:7] == "Bearer " {
+		token = token[7:]
+	}
+	return token
+}
+
 // generateToken creates a random session token
 func generateToken() (string, error) {
 	bytes := make([]byte, 32)
@@ -1,11 +1,14 @@
 package handlers
 
 import (
+	"fmt"
 	"io"
+	"log"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -18,51 +21,114 @@ type FileInfo struct {
 	IsDir    bool      `json:"isDir"`
 	ModTime  time.Time `json:"modTime"`
 	MimeType string    `json:"mimeType"`
+	Category string    `json:"category"`
 }
 
+// FileListResponse is one page of a directory listing
 type FileListResponse struct {
 	CurrentPath string     `json:"currentPath"`
 	Files       []FileInfo `json:"files"`
-	TotalSize   int64      `json:"totalSize"`
+	// TotalSize sums the files on this page
+	TotalSize int64 `json:"totalSize"`
+	// Total counts the matching entries across all pages
+	Total int `json:"total"`
+	Limit int `json:"limit"`
+	// NextCursor is passed as ?cursor= to fetch the following page
+	NextCursor string `json:"nextCursor,omitempty"`
+	HasMore    bool   `json:"hasMore"`
 }
 
-// GetFiles returns list of files in a directory
+// GetFiles returns a page of the entries in a directory. Folders the
+// caller may not read are left out. Supported parameters: sort (name,
+// size, modTime or type), order (asc or desc), hidden=true to include
+// dotfiles, pattern (a glob on names), limit, cursor from the previous
+// page and sizes=true to report the total size of each folder.
 func GetFiles(c *gin.Context) {
-	path := c.DefaultQuery("path", "/Users/Shared")
-	
-	// Security check - prevent directory traversal
-	cleanPath := filepath.Clean(path)
-	if strings.Contains(cleanPath, "..") {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
+	user := c.MustGet("user").(*User)
+
+	cleanPath, ok := resolveRequestPath(c, c.DefaultQuery("path", storage.Default()))
+	if !ok {
+		return
+	}
+	if !requireAccess(c, cleanPath, ACLRead) {
+		return
+	}
+
+	opts := ListOptions{
+		Sort:    c.DefaultQuery("sort", SortByName),
+		Hidden:  c.Query("hidden") == "true",
+		Pattern: c.Query("pattern"),
+		Limit:   defaultListLimit,
+		Visible: func(path string) bool { return aclManager.Allowed(user, path, ACLRead) },
+	}
+	switch opts.Sort {
+	case SortByName, SortBySize, SortByModTime, SortByType:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sort"})
+		return
+	}
+	switch c.DefaultQuery("order", "asc") {
+	case "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order"})
 		return
 	}
+	if _, err := filepath.Match(opts.Pattern, ""); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pattern"})
+		return
+	}
+	if v := c.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		opts.Limit = min(limit, maxListLimit)
+	}
+	if v := c.Query("cursor"); v != "" {
+		cursor, err := parseListCursor(v, opts)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor for this sort order"})
+			return
+		}
+		opts.Cursor = cursor
+	}
 
-	files, err := os.ReadDir(cleanPath)
+	entries, total, next, err := listDirectory(cleanPath, opts)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot read directory"})
 		return
 	}
 
-	var fileList []FileInfo
+	fileList := make([]FileInfo, 0, len(entries))
 	var totalSize int64
 
-	for _, file := range files {
-		info, err := file.Info()
+	for _, entry := range entries {
+		fileInfo := FileInfo{
+			Name:  entry.name,
+			Path:  filepath.Join(cleanPath, entry.name),
+			IsDir: entry.isDir,
+		}
+		info, err := os.Lstat(fileInfo.Path)
 		if err != nil {
 			continue
 		}
-
-		fileInfo := FileInfo{
-			Name:    file.Name(),
-			Path:    filepath.Join(cleanPath, file.Name()),
-			Size:    info.Size(),
-			IsDir:   file.IsDir(),
-			ModTime: info.ModTime(),
-		}
-
-		if !file.IsDir() {
+		fileInfo.Size = info.Size()
+		fileInfo.ModTime = info.ModTime()
+
+		if entry.isDir {
+			fileInfo.Category = CategoryFolder
+			if c.Query("sizes") == "true" {
+				if _, size, err := measureTree(fileInfo.Path); err == nil {
+					fileInfo.Size = size
+				}
+			}
+		} else {
 			totalSize += info.Size()
-			fileInfo.MimeType = getMimeType(file.Name())
+			fileInfo.MimeType = detectMimeType(fileInfo.Path)
+			fileInfo.Category = fileCategory(entry.name, fileInfo.MimeType)
 		}
 
 		fileList = append(fileList, fileInfo)
@@ -72,19 +138,22 @@ func GetFiles(c *gin.Context) {
 		CurrentPath: cleanPath,
 		Files:       fileList,
 		TotalSize:   totalSize,
+		Total:       total,
+		Limit:       opts.Limit,
+		NextCursor:  next,
+		HasMore:     next != "",
 	}
 
 	c.JSON(http.StatusOK, response)
 }
 
-// UploadFile handles file uploads
+// UploadFile handles file uploads. A file being replaced is kept as a
+// version first.
 func UploadFile(c *gin.Context) {
-	uploadPath := c.DefaultQuery("path", "/Users/Shared")
-	
-	// Security check
-	cleanPath := filepath.Clean(uploadPath)
-	if strings.Contains(cleanPath, "..") {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
+	user := c.MustGet("user").(*User)
+
+	cleanPath, ok := resolveRequestPath(c, c.DefaultQuery("path", storage.Default()))
+	if !ok {
 		return
 	}
 
@@ -95,21 +164,30 @@ func UploadFile(c *gin.Context) {
 	}
 	defer file.Close()
 
-	// Create destination file
-	destPath := filepath.Join(cleanPath, header.Filename)
-	dest, err := os.Create(destPath)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot create file"})
+	// Create destination file; resolve again in case the name is an
+	// existing symlink pointing elsewhere
+	destPath, ok := resolveRequestPath(c, filepath.Join(cleanPath, filepath.Base(header.Filename)))
+	if !ok {
+		return
+	}
+	if !requireAccess(c, filepath.Dir(destPath), ACLWrite) || !requireReplaceAccess(c, destPath) {
 		return
 	}
-	defer dest.Close()
 
-	// Copy file content
-	_, err = io.Copy(dest, file)
-	if err != nil {
+	reservation, ok := reserveQuota(c, user.Username, destPath, header.Size)
+	if !ok {
+		return
+	}
+	defer quotaManager.Release(reservation)
+	if err := versionManager.Snapshot(destPath, user.Username); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot keep previous version"})
+		return
+	}
+	if err := saveFile(file, destPath); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot save file"})
 		return
 	}
+	chargeFile(destPath, user.Username)
 
 	c.JSON(http.StatusOK, gin.H{
 		"message":  "File uploaded successfully",
@@ -119,7 +197,31 @@ func UploadFile(c *gin.Context) {
 	})
 }
 
-// DownloadFile handles file downloads
+// saveFile writes r beside destPath and renames it into place, so that an
+// interrupted upload never leaves a partial file under the real name
+func saveFile(r io.Reader, destPath string) error {
+	dest, err := os.CreateTemp(filepath.Dir(destPath), "."+filepath.Base(destPath)+".*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dest.Name())
+
+	_, err = io.Copy(dest, r)
+	if closeErr := dest.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(dest.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(dest.Name(), destPath)
+}
+
+// DownloadFile streams a file with support for byte ranges and conditional
+// requests. ?disposition=inline lets the browser display it instead of
+// saving it, e.g. for video playback.
 func DownloadFile(c *gin.Context) {
 	filePath := c.Query("path")
 	if filePath == "" {
@@ -127,44 +229,129 @@ func DownloadFile(c *gin.Context) {
 		return
 	}
 
-	// Security check
-	cleanPath := filepath.Clean(filePath)
-	if strings.Contains(cleanPath, "..") {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
+	cleanPath, ok := resolveRequestPath(c, filePath)
+	if !ok {
+		return
+	}
+	if !requireAccess(c, cleanPath, ACLRead) {
 		return
 	}
 
-	// Check if file exists
-	if _, err := os.Stat(cleanPath); os.IsNotExist(err) {
+	serveFile(c, cleanPath, filepath.Base(cleanPath), c.DefaultQuery("disposition", "attachment"))
+}
+
+// serveFile writes path to the response under the given download name.
+// http.ServeContent takes care of Range, If-Range, If-None-Match and
+// If-Modified-Since once ETag and Content-Type are set.
+func serveFile(c *gin.Context, path, name, disposition string) {
+	f, err := os.Open(path)
+	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
 		return
 	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Not a file"})
+		return
+	}
+
+	contentType, err := sniffContentType(f, name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot read file"})
+		return
+	}
+
+	if disposition != "inline" {
+		disposition = "attachment"
+	}
+
+	header := c.Writer.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+	header.Set("ETag", fileETag(info))
+	header.Set("Cache-Control", "private, no-cache")
+	header.Set("X-Content-Type-Options", "nosniff")
+	if disposition == "inline" && isActiveContent(contentType) {
+		// HTML and SVG could run script with the NAS's origin otherwise
+		header.Set("Content-Security-Policy", "sandbox")
+	}
 
-	c.File(cleanPath)
+	http.ServeContent(c.Writer, c.Request, name, info.ModTime(), f)
 }
 
-// DeleteFile handles file deletion
+// fileETag is a strong validator derived from size and modification time,
+// usable with If-Range
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// isActiveContent reports whether a browser may execute script in a
+// document of this type
+func isActiveContent(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/html", "application/xhtml+xml", "image/svg+xml", "text/xml", "application/xml":
+		return true
+	}
+	return false
+}
+
+// DeleteFile moves a file or folder to its volume's trash, or removes it
+// outright with ?permanent=true
 func DeleteFile(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
 	filePath := c.Query("path")
 	if filePath == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "File path required"})
 		return
 	}
 
-	// Security check
-	cleanPath := filepath.Clean(filePath)
-	if strings.Contains(cleanPath, "..") {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
+	// Symlinks are removed themselves rather than followed
+	cleanPath, ok := resolveRequestEntry(c, filePath)
+	if !ok {
+		return
+	}
+	if storage.IsRoot(cleanPath) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot delete a storage volume"})
+		return
+	}
+	if !requireTreeAccess(c, cleanPath, ACLDelete) {
+		return
+	}
+
+	if _, err := os.Lstat(cleanPath); os.IsNotExist(err) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
 		return
 	}
 
-	err := os.Remove(cleanPath)
+	if c.Query("permanent") == "true" {
+		if err := os.RemoveAll(cleanPath); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot delete file"})
+			return
+		}
+		if err := quotaManager.Forget(cleanPath); err != nil {
+			log.Printf("Failed to release quota for %s: %v", cleanPath, err)
+		}
+		if err := aclManager.Forget(cleanPath); err != nil {
+			log.Printf("Failed to remove ACLs below %s: %v", cleanPath, err)
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "File deleted permanently"})
+		return
+	}
+
+	item, err := trashManager.Trash(cleanPath, user)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot delete file"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "File deleted successfully"})
+	c.JSON(http.StatusOK, gin.H{
+		"message": "File moved to trash",
+		"item":    item,
+	})
 }
 
 // CreateFolder handles folder creation
@@ -179,14 +366,18 @@ func CreateFolder(c *gin.Context) {
 		return
 	}
 
-	// Security check
-	cleanPath := filepath.Clean(request.Path)
-	if strings.Contains(cleanPath, "..") || strings.Contains(request.Name, "..") {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
+	if request.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Folder name required"})
 		return
 	}
 
-	folderPath := filepath.Join(cleanPath, request.Name)
+	folderPath, ok := resolveRequestPath(c, filepath.Join(request.Path, request.Name))
+	if !ok {
+		return
+	}
+	if !requireAccess(c, filepath.Dir(folderPath), ACLWrite) {
+		return
+	}
 	err := os.MkdirAll(folderPath, 0755)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot create folder"})
@@ -198,28 +389,3 @@ func CreateFolder(c *gin.Context) {
 		"path":    folderPath,
 	})
 }
-
-// getMimeType returns MIME type based on file extension
-func getMimeType(filename string) string {
-	ext := strings.ToLower(filepath.Ext(filename))
-	switch ext {
-	case ".jpg", ".jpeg":
-		return "image/jpeg"
-	case ".png":
-		return "image/png"
-	case ".gif":
-		return "image/gif"
-	case ".pdf":
-		return "application/pdf"
-	case ".txt":
-		return "text/plain"
-	case ".mp4":
-		return "video/mp4"
-	case ".mp3":
-		return "audio/mpeg"
-	case ".zip":
-		return "application/zip"
-	default:
-		return "application/octet-stream"
-	}
-}
\ No newline at end of file
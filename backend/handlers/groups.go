@@ -0,0 +1,421 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	ErrGroupNotFound = errors.New("group not found")
+	ErrGroupExists   = errors.New("group already exists")
+)
+
+var groupsBucket = []byte("groups")
+
+// Group is a named set of users. Members inherit the group's roles, and
+// shares and file ACLs may grant access to the whole group.
+type Group struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Members     []string  `json:"members"`
+	Roles       []string  `json:"roles"`
+	Created     time.Time `json:"created"`
+}
+
+type GroupRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Members     []string `json:"members"`
+	Roles       []string `json:"roles"`
+}
+
+type GroupMemberRequest struct {
+	Username string `json:"username" binding:"required"`
+}
+
+// GroupManager caches groups in memory since membership is consulted on
+// every permission check
+type GroupManager struct {
+	mu     sync.RWMutex
+	db     *bolt.DB
+	groups map[string]Group
+}
+
+var groupManager *GroupManager
+
+// SetGroupManager configures the manager used for group lookups
+func SetGroupManager(manager *GroupManager) {
+	groupManager = manager
+}
+
+// NewGroupManager loads all groups from db
+func NewGroupManager(db *bolt.DB) (*GroupManager, error) {
+	m := &GroupManager{
+		db:     db,
+		groups: make(map[string]Group),
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(groupsBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(_, v []byte) error {
+			var group Group
+			if err := json.Unmarshal(v, &group); err != nil {
+				return err
+			}
+			m.groups[group.Name] = group
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Get returns the named group
+func (m *GroupManager) Get(name string) (Group, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	group, exists := m.groups[name]
+	if !exists {
+		return Group{}, ErrGroupNotFound
+	}
+	return group, nil
+}
+
+// List returns all groups sorted by name
+func (m *GroupManager) List() []Group {
+	m.mu.RLock()
+	list := make([]Group, 0, len(m.groups))
+	for _, group := range m.groups {
+		list = append(list, group)
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// GroupsFor returns the groups username belongs to
+func (m *GroupManager) GroupsFor(username string) []Group {
+	m.mu.RLock()
+	var list []Group
+	for _, group := range m.groups {
+		if containsString(group.Members, username) {
+			list = append(list, group)
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// IsMember reports whether username belongs to the named group
+func (m *GroupManager) IsMember(name, username string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	group, exists := m.groups[name]
+	return exists && containsString(group.Members, username)
+}
+
+// Save creates or replaces a group
+func (m *GroupManager) Save(group Group, create bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, exists := m.groups[group.Name]
+	if create && exists {
+		return ErrGroupExists
+	}
+	if !create && !exists {
+		return ErrGroupNotFound
+	}
+	if exists {
+		group.Created = existing.Created
+	}
+
+	return m.put(group)
+}
+
+// Update applies fn to the named group and stores the result
+func (m *GroupManager) Update(name string, fn func(*Group)) (Group, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	group, exists := m.groups[name]
+	if !exists {
+		return Group{}, ErrGroupNotFound
+	}
+	group.Members = append([]string(nil), group.Members...)
+	group.Roles = append([]string(nil), group.Roles...)
+	fn(&group)
+
+	return group, m.put(group)
+}
+
+// Delete removes a group
+func (m *GroupManager) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.groups[name]; !exists {
+		return ErrGroupNotFound
+	}
+
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(groupsBucket).Delete([]byte(name))
+	})
+	if err != nil {
+		return err
+	}
+
+	delete(m.groups, name)
+	return nil
+}
+
+// RemoveUser drops username from every group, e.g. when the user is deleted
+func (m *GroupManager) RemoveUser(username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, group := range m.groups {
+		if !containsString(group.Members, username) {
+			continue
+		}
+		group.Members = removeString(group.Members, username)
+		if err := m.put(group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// put stores group; the caller must hold m.mu
+func (m *GroupManager) put(group Group) error {
+	data, err := json.Marshal(group)
+	if err != nil {
+		return err
+	}
+	err = m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(groupsBucket).Put([]byte(group.Name), data)
+	})
+	if err != nil {
+		return err
+	}
+
+	m.groups[group.Name] = group
+	return nil
+}
+
+// validateGroupNames checks that every name refers to an existing group
+func validateGroupNames(names []string) error {
+	for _, name := range names {
+		if _, err := groupManager.Get(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetGroups lists all groups
+func GetGroups(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"groups": groupManager.List()})
+}
+
+// GetGroup returns a single group
+func GetGroup(c *gin.Context) {
+	group, err := groupManager.Get(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"group": group})
+}
+
+// CreateGroup defines a new group
+func CreateGroup(c *gin.Context) {
+	var req GroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !roleNamePattern.MatchString(req.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group name"})
+		return
+	}
+
+	saveGroup(c, req, true)
+}
+
+// UpdateGroup replaces a group's description, members and roles
+func UpdateGroup(c *gin.Context) {
+	var req GroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	req.Name = c.Param("name")
+	saveGroup(c, req, false)
+}
+
+// DeleteGroup removes a group along with the folder ACL entries and quotas
+// naming it
+func DeleteGroup(c *gin.Context) {
+	name := c.Param("name")
+	if err := groupManager.Delete(name); err != nil {
+		writeGroupError(c, err)
+		return
+	}
+	// A group created later under the same name must not inherit these
+	if err := aclManager.RemovePrincipal(ACLKindGroup, name); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update folder ACLs"})
+		return
+	}
+	if err := quotaManager.DeletePrincipal(QuotaKindGroup, name); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete quotas"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Group deleted successfully"})
+}
+
+// AddGroupMember adds a user to a group
+func AddGroupMember(c *gin.Context) {
+	var req GroupMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := userStore.GetUser(req.Username); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown user: " + req.Username})
+		return
+	}
+
+	group, err := groupManager.Update(c.Param("name"), func(g *Group) {
+		if !containsString(g.Members, req.Username) {
+			g.Members = append(g.Members, req.Username)
+			sort.Strings(g.Members)
+		}
+	})
+	if err != nil {
+		writeGroupError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"group": group})
+}
+
+// RemoveGroupMember removes a user from a group
+func RemoveGroupMember(c *gin.Context) {
+	username := c.Param("username")
+
+	member := false
+	group, err := groupManager.Update(c.Param("name"), func(g *Group) {
+		member = containsString(g.Members, username)
+		g.Members = removeString(g.Members, username)
+	})
+	if err != nil {
+		writeGroupError(c, err)
+		return
+	}
+	if !member {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User is not a member of this group"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"group": group})
+}
+
+func saveGroup(c *gin.Context, req GroupRequest, create bool) {
+	for _, username := range req.Members {
+		if _, err := userStore.GetUser(username); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown user: " + username})
+			return
+		}
+	}
+	for _, role := range req.Roles {
+		if _, err := roleManager.Get(role); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role: " + role})
+			return
+		}
+	}
+
+	group := Group{
+		Name:        req.Name,
+		Description: req.Description,
+		Members:     uniqueSorted(req.Members),
+		Roles:       uniqueSorted(req.Roles),
+		Created:     time.Now(),
+	}
+
+	if err := groupManager.Save(group, create); err != nil {
+		writeGroupError(c, err)
+		return
+	}
+
+	group, _ = groupManager.Get(group.Name)
+	status := http.StatusOK
+	if create {
+		status = http.StatusCreated
+	}
+	c.JSON(status, gin.H{"group": group})
+}
+
+func writeGroupError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrGroupNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+	case errors.Is(err, ErrGroupExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "Group already exists"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save group"})
+	}
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(list []string, value string) []string {
+	result := make([]string, 0, len(list))
+	for _, item := range list {
+		if item != value {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// uniqueSorted returns a sorted copy of list without duplicates
+func uniqueSorted(list []string) []string {
+	result := []string{}
+	for _, item := range list {
+		if !containsString(result, item) {
+			result = append(result, item)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
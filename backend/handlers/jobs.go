@@ -0,0 +1,315 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var ErrJobNotFound = errors.New("job not found")
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobCompleted JobStatus = "completed"
+	JobFailed    JobStatus = "failed"
+	JobCancelled JobStatus = "cancelled"
+)
+
+// JobProgress counts the work done by a job against its total
+type JobProgress struct {
+	TotalBytes int64  `json:"totalBytes"`
+	DoneBytes  int64  `json:"doneBytes"`
+	TotalFiles int    `json:"totalFiles"`
+	DoneFiles  int    `json:"doneFiles"`
+	Current    string `json:"current,omitempty"`
+}
+
+// Job is a long-running file operation executed in the background. Jobs
+// live in memory only; anything running when the server stops is lost.
+type Job struct {
+	ID          string      `json:"id"`
+	Type        string      `json:"type"`
+	UserID      int         `json:"userId"`
+	Username    string      `json:"username"`
+	Status      JobStatus   `json:"status"`
+	Sources     []string    `json:"sources"`
+	Destination string      `json:"destination,omitempty"`
+	Progress    JobProgress `json:"progress"`
+	// Results holds the final path of each source once it is done
+	Results  []string   `json:"results"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+// snapshot returns a copy that is safe to serialize while the job runs
+func (j *Job) snapshot() *Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return &Job{
+		ID:          j.ID,
+		Type:        j.Type,
+		UserID:      j.UserID,
+		Username:    j.Username,
+		Status:      j.Status,
+		Sources:     j.Sources,
+		Destination: j.Destination,
+		Progress:    j.Progress,
+		Results:     append([]string{}, j.Results...),
+		Error:       j.Error,
+		Created:     j.Created,
+		Started:     j.Started,
+		Finished:    j.Finished,
+	}
+}
+
+// AddTotal grows the amount of work the job expects to do
+func (j *Job) AddTotal(files int, bytes int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Progress.TotalFiles += files
+	j.Progress.TotalBytes += bytes
+}
+
+// Advance records bytes written for the current file
+func (j *Job) Advance(bytes int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Progress.DoneBytes += bytes
+}
+
+// StartFile marks path as the file being worked on
+func (j *Job) StartFile(path string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Progress.Current = path
+}
+
+// FinishFile counts a file as done
+func (j *Job) FinishFile() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Progress.DoneFiles++
+}
+
+// AddResult records the final location of a source
+func (j *Job) AddResult(path string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Results = append(j.Results, path)
+}
+
+// JobManager runs jobs with bounded concurrency and keeps finished ones
+// around for a while so clients can collect the outcome
+type JobManager struct {
+	mu        sync.Mutex
+	jobs      map[string]*Job
+	slots     chan struct{}
+	retention time.Duration
+}
+
+var jobManager *JobManager
+
+// SetJobManager configures the manager used for background file operations
+func SetJobManager(manager *JobManager) {
+	jobManager = manager
+}
+
+// NewJobManager runs at most concurrency jobs at once and forgets finished
+// jobs after retention
+func NewJobManager(concurrency int, retention time.Duration) *JobManager {
+	return &JobManager{
+		jobs:      make(map[string]*Job),
+		slots:     make(chan struct{}, concurrency),
+		retention: retention,
+	}
+}
+
+// Submit queues job and runs fn for it in the background
+func (m *JobManager) Submit(job *Job, fn func(ctx context.Context, job *Job) error) error {
+	id, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job.ID = id[:16]
+	job.Status = JobQueued
+	job.Created = time.Now()
+	job.Results = []string{}
+	job.cancel = cancel
+
+	m.mu.Lock()
+	m.jobs[job.ID] = job
+	m.mu.Unlock()
+
+	go func() {
+		defer cancel()
+
+		select {
+		case m.slots <- struct{}{}:
+			defer func() { <-m.slots }()
+		case <-ctx.Done():
+			m.finish(job, ctx.Err())
+			return
+		}
+
+		now := time.Now()
+		job.mu.Lock()
+		job.Status = JobRunning
+		job.Started = &now
+		job.mu.Unlock()
+
+		err := fn(ctx, job)
+		if err == nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		m.finish(job, err)
+	}()
+	return nil
+}
+
+func (m *JobManager) finish(job *Job, err error) {
+	now := time.Now()
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	job.Finished = &now
+	job.Progress.Current = ""
+	switch {
+	case err == nil:
+		job.Status = JobCompleted
+	case errors.Is(err, context.Canceled):
+		job.Status = JobCancelled
+	default:
+		job.Status = JobFailed
+		job.Error = err.Error()
+	}
+}
+
+// Get returns a snapshot of the job with id if it belongs to userID
+func (m *JobManager) Get(id string, userID int) (*Job, error) {
+	m.mu.Lock()
+	job, exists := m.jobs[id]
+	m.mu.Unlock()
+
+	if !exists || job.UserID != userID {
+		return nil, ErrJobNotFound
+	}
+	return job.snapshot(), nil
+}
+
+// List returns snapshots of userID's jobs, newest first
+func (m *JobManager) List(userID int) []*Job {
+	m.mu.Lock()
+	var owned []*Job
+	for _, job := range m.jobs {
+		if job.UserID == userID {
+			owned = append(owned, job)
+		}
+	}
+	m.mu.Unlock()
+
+	list := make([]*Job, 0, len(owned))
+	for _, job := range owned {
+		list = append(list, job.snapshot())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+	return list
+}
+
+// Cancel stops a queued or running job
+func (m *JobManager) Cancel(id string, userID int) error {
+	m.mu.Lock()
+	job, exists := m.jobs[id]
+	m.mu.Unlock()
+
+	if !exists || job.UserID != userID {
+		return ErrJobNotFound
+	}
+	job.cancel()
+	return nil
+}
+
+// Prune forgets jobs that finished more than the retention period ago
+func (m *JobManager) Prune() {
+	cutoff := time.Now().Add(-m.retention)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, job := range m.jobs {
+		job.mu.Lock()
+		expired := job.Finished != nil && job.Finished.Before(cutoff)
+		job.mu.Unlock()
+		if expired {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+// StartReaper prunes finished jobs every interval until stop is called
+func (m *JobManager) StartReaper(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				m.Prune()
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// GetJobs lists the current user's background jobs
+func GetJobs(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+	c.JSON(http.StatusOK, gin.H{"jobs": jobManager.List(user.ID)})
+}
+
+// GetJob reports the status and progress of a background job
+func GetJob(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	job, err := jobManager.Get(c.Param("id"), user.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"job": job})
+}
+
+// CancelJob stops a background job. Work already done is kept.
+func CancelJob(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	if err := jobManager.Cancel(c.Param("id"), user.ID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Job cancelled"})
+}
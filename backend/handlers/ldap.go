@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+var ErrLDAPInvalidCredentials = errors.New("invalid LDAP credentials")
+
+// LDAPGroupRole maps members of an LDAP group to a local role
+type LDAPGroupRole struct {
+	Group string
+	Role  string
+}
+
+type LDAPConfig struct {
+	URL                string
+	StartTLS           bool
+	InsecureSkipVerify bool
+	BindDN             string
+	BindPassword       string
+	BaseDN             string
+	// UserFilter selects the user entry; {username} is replaced with the
+	// escaped login name
+	UserFilter     string
+	EmailAttribute string
+	GroupAttribute string
+	// GroupBaseDN and GroupFilter, when set, look up groups by searching
+	// instead of reading GroupAttribute; {dn} and {username} are replaced
+	GroupBaseDN string
+	GroupFilter string
+	GroupRoles  []LDAPGroupRole
+	DefaultRole string
+	// Provision creates local accounts for directory users on first login
+	Provision bool
+}
+
+// LDAPConn is the subset of an LDAP connection used by the authenticator
+type LDAPConn interface {
+	Bind(username, password string) error
+	Search(request *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// ExternalIdentity is a user verified by an external identity provider
+type ExternalIdentity struct {
+	Username string
+	Email    string
+	Role     string
+	Groups   []string
+	// Issuer and Subject are set for single sign-on identities only
+	Issuer  string
+	Subject string
+}
+
+// LDAPAuthenticator verifies passwords against an LDAP directory using the
+// usual search-then-bind sequence
+type LDAPAuthenticator struct {
+	config LDAPConfig
+	// Dial opens a connection; it can be replaced to talk to a stand-in
+	Dial func() (LDAPConn, error)
+}
+
+var ldapAuthenticator *LDAPAuthenticator
+
+// SetLDAPAuthenticator enables LDAP logins; nil disables them
+func SetLDAPAuthenticator(authenticator *LDAPAuthenticator) {
+	ldapAuthenticator = authenticator
+}
+
+// NewLDAPAuthenticator returns an authenticator for config, filling in
+// defaults suitable for OpenLDAP and Active Directory
+func NewLDAPAuthenticator(config LDAPConfig) *LDAPAuthenticator {
+	if config.UserFilter == "" {
+		config.UserFilter = "(|(uid={username})(sAMAccountName={username}))"
+	}
+	if config.EmailAttribute == "" {
+		config.EmailAttribute = "mail"
+	}
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = "memberOf"
+	}
+	if config.DefaultRole == "" {
+		config.DefaultRole = "user"
+	}
+
+	a := &LDAPAuthenticator{config: config}
+	a.Dial = a.dial
+	return a
+}
+
+// Provision reports whether unknown directory users get local accounts
+func (a *LDAPAuthenticator) Provision() bool {
+	return a.config.Provision
+}
+
+// Authenticate checks username and password against the directory and
+// returns the user's identity with its mapped role
+func (a *LDAPAuthenticator) Authenticate(username, password string) (*ExternalIdentity, error) {
+	// An empty password would be an unauthenticated bind, which many
+	// servers report as success
+	if username == "" || password == "" {
+		return nil, ErrLDAPInvalidCredentials
+	}
+
+	conn, err := a.Dial()
+	if err != nil {
+		return nil, fmt.Errorf("connect to LDAP server: %w", err)
+	}
+	defer conn.Close()
+
+	if a.config.BindDN != "" {
+		if err := conn.Bind(a.config.BindDN, a.config.BindPassword); err != nil {
+			return nil, fmt.Errorf("service bind: %w", err)
+		}
+	}
+
+	escaped := ldap.EscapeFilter(username)
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.config.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false,
+		strings.ReplaceAll(a.config.UserFilter, "{username}", escaped),
+		[]string{"dn", a.config.EmailAttribute, a.config.GroupAttribute},
+		nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("search user: %w", err)
+	}
+	if len(result.Entries) != 1 {
+		return nil, ErrLDAPInvalidCredentials
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrLDAPInvalidCredentials
+		}
+		return nil, fmt.Errorf("user bind: %w", err)
+	}
+
+	groups := entry.GetAttributeValues(a.config.GroupAttribute)
+	if a.config.GroupBaseDN != "" && a.config.GroupFilter != "" {
+		groups, err = a.searchGroups(conn, entry.DN, username)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &ExternalIdentity{
+		Username: username,
+		Email:    entry.GetAttributeValue(a.config.EmailAttribute),
+		Role:     a.roleFor(groups),
+		Groups:   groups,
+	}, nil
+}
+
+func (a *LDAPAuthenticator) searchGroups(conn LDAPConn, dn, username string) ([]string, error) {
+	// The service account may not read groups after a user bind
+	if a.config.BindDN != "" {
+		if err := conn.Bind(a.config.BindDN, a.config.BindPassword); err != nil {
+			return nil, fmt.Errorf("service bind: %w", err)
+		}
+	}
+
+	filter := strings.NewReplacer(
+		"{dn}", ldap.EscapeFilter(dn),
+		"{username}", ldap.EscapeFilter(username),
+	).Replace(a.config.GroupFilter)
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.config.GroupBaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 10, false,
+		filter, []string{"dn"}, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("search groups: %w", err)
+	}
+
+	groups := make([]string, 0, len(result.Entries))
+	for _, entry := range result.Entries {
+		groups = append(groups, entry.DN)
+	}
+	return groups, nil
+}
+
+// roleFor returns the role of the first configured group the user is in
+func (a *LDAPAuthenticator) roleFor(groups []string) string {
+	for _, mapping := range a.config.GroupRoles {
+		for _, group := range groups {
+			if strings.EqualFold(group, mapping.Group) {
+				return mapping.Role
+			}
+		}
+	}
+	return a.config.DefaultRole
+}
+
+func (a *LDAPAuthenticator) dial() (LDAPConn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: a.config.InsecureSkipVerify}
+
+	conn, err := ldap.DialURL(a.config.URL,
+		ldap.DialWithTLSConfig(tlsConfig),
+		ldap.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.config.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// authenticateLDAP verifies credentials against the directory and returns
+// the matching local user, syncing or provisioning it as configured. Local
+// accounts are never taken over by directory entries of the same name.
+// Directories match names case-insensitively, so accounts are keyed on the
+// lowercased name to keep "Alice" and "alice" from becoming two users.
+func authenticateLDAP(username, password string) (*User, error) {
+	username = normalizeUsername(username)
+	existing, err := userStore.GetUser(username)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return nil, err
+	}
+	if existing != nil && existing.Source != UserSourceLDAP {
+		return nil, ErrLDAPInvalidCredentials
+	}
+	if existing == nil && !ldapAuthenticator.Provision() {
+		return nil, ErrLDAPInvalidCredentials
+	}
+
+	identity, err := ldapAuthenticator.Authenticate(username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing == nil {
+		user := &User{
+			Username: identity.Username,
+			Email:    identity.Email,
+			Role:     identity.Role,
+			Source:   UserSourceLDAP,
+			Created:  time.Now(),
+		}
+		if err := userStore.CreateUser(user, ""); err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+
+	if existing.Email != identity.Email || existing.Role != identity.Role {
+		existing.Email = identity.Email
+		existing.Role = identity.Role
+		if err := userStore.UpdateUser(existing); err != nil {
+			return nil, err
+		}
+	}
+	return existing, nil
+}
@@ -0,0 +1,358 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	testServiceDN = "cn=nas,ou=services,dc=example,dc=org"
+	testGroupBase = "ou=groups,dc=example,dc=org"
+)
+
+// fakeDirectoryEntry is a user or group in a fakeDirectory
+type fakeDirectoryEntry struct {
+	uid        string
+	password   string
+	attributes map[string][]string
+}
+
+// fakeDirectory stands in for an LDAP server. It understands the user and
+// group filters used below well enough to answer them, and only lets the
+// service account search.
+type fakeDirectory struct {
+	entries map[string]fakeDirectoryEntry
+	bound   string
+	dials   int
+	filters []string
+}
+
+func newFakeDirectory() *fakeDirectory {
+	return &fakeDirectory{entries: map[string]fakeDirectoryEntry{
+		testServiceDN: {password: "service-secret"},
+		"uid=alice,ou=people,dc=example,dc=org": {
+			uid:      "alice",
+			password: "alice-pass",
+			attributes: map[string][]string{
+				"mail":     {"alice@example.org"},
+				"memberOf": {"cn=staff," + testGroupBase, "CN=NAS-Admins," + testGroupBase},
+			},
+		},
+		"uid=bob,ou=people,dc=example,dc=org": {
+			uid:      "bob",
+			password: "bob-pass",
+			attributes: map[string][]string{
+				"mail":     {"bob@example.org"},
+				"memberOf": {"cn=staff," + testGroupBase},
+			},
+		},
+		"cn=staff," + testGroupBase: {
+			attributes: map[string][]string{
+				"member": {"uid=alice,ou=people,dc=example,dc=org", "uid=bob,ou=people,dc=example,dc=org"},
+			},
+		},
+		"cn=nas-admins," + testGroupBase: {
+			attributes: map[string][]string{
+				"member": {"uid=alice,ou=people,dc=example,dc=org"},
+			},
+		},
+	}}
+}
+
+func (d *fakeDirectory) dial() (LDAPConn, error) {
+	d.dials++
+	d.bound = ""
+	return d, nil
+}
+
+func (d *fakeDirectory) Bind(username, password string) error {
+	entry, exists := d.entries[username]
+	if !exists || password == "" || entry.password != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	d.bound = username
+	return nil
+}
+
+func (d *fakeDirectory) Search(request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if d.bound != testServiceDN {
+		return nil, ldap.NewError(ldap.LDAPResultInsufficientAccessRights, errors.New("not bound"))
+	}
+	d.filters = append(d.filters, request.Filter)
+
+	result := &ldap.SearchResult{}
+	for dn, entry := range d.entries {
+		var match bool
+		if request.BaseDN == testGroupBase {
+			for _, member := range entry.attributes["member"] {
+				match = match || strings.Contains(request.Filter, "(member="+ldap.EscapeFilter(member)+")")
+			}
+		} else {
+			match = entry.uid != "" && strings.Contains(request.Filter, "(uid="+entry.uid+")")
+		}
+		if match {
+			result.Entries = append(result.Entries, ldap.NewEntry(dn, entry.attributes))
+		}
+	}
+	return result, nil
+}
+
+func (d *fakeDirectory) Close() error {
+	return nil
+}
+
+// setupLDAPTest prepares the package as setupAuthTest does and enables
+// LDAP logins against a fake directory
+func setupLDAPTest(t *testing.T, config LDAPConfig) *fakeDirectory {
+	t.Helper()
+	setupAuthTest(t)
+
+	config.BindDN = testServiceDN
+	config.BindPassword = "service-secret"
+	config.BaseDN = "ou=people,dc=example,dc=org"
+
+	directory := newFakeDirectory()
+	authenticator := NewLDAPAuthenticator(config)
+	authenticator.Dial = directory.dial
+	SetLDAPAuthenticator(authenticator)
+	t.Cleanup(func() { SetLDAPAuthenticator(nil) })
+	return directory
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	directory := setupLDAPTest(t, LDAPConfig{})
+
+	identity, err := ldapAuthenticator.Authenticate("alice", "alice-pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Username != "alice" || identity.Email != "alice@example.org" || len(identity.Groups) != 2 {
+		t.Errorf("got %+v", identity)
+	}
+	if identity.Role != "user" {
+		t.Errorf("role without mappings: got %q, want the default", identity.Role)
+	}
+
+	for _, tc := range []struct{ username, password string }{
+		{"alice", "wrong"},
+		{"alice", ""},
+		{"carol", "carol-pass"},
+		// Filter syntax in names is escaped rather than matching everyone
+		{"*", "alice-pass"},
+		{"alice)(uid=*", "alice-pass"},
+	} {
+		if _, err := ldapAuthenticator.Authenticate(tc.username, tc.password); !errors.Is(err, ErrLDAPInvalidCredentials) {
+			t.Errorf("%q/%q: got %v, want invalid credentials", tc.username, tc.password, err)
+		}
+	}
+
+	for _, filter := range directory.filters {
+		if strings.Contains(filter, "(uid=*)") {
+			t.Errorf("unescaped filter %q", filter)
+		}
+	}
+}
+
+func TestLDAPGroupRoles(t *testing.T) {
+	roles := []LDAPGroupRole{
+		{Group: "cn=nas-admins," + testGroupBase, Role: "admin"},
+		{Group: "cn=staff," + testGroupBase, Role: "readonly"},
+	}
+
+	t.Run("memberOf", func(t *testing.T) {
+		setupLDAPTest(t, LDAPConfig{GroupRoles: roles})
+
+		// Group names compare without regard to case, and the first
+		// mapping the user matches wins
+		if identity, err := ldapAuthenticator.Authenticate("alice", "alice-pass"); err != nil || identity.Role != "admin" {
+			t.Errorf("alice: got %+v, %v", identity, err)
+		}
+		if identity, err := ldapAuthenticator.Authenticate("bob", "bob-pass"); err != nil || identity.Role != "readonly" {
+			t.Errorf("bob: got %+v, %v", identity, err)
+		}
+	})
+
+	t.Run("group search", func(t *testing.T) {
+		setupLDAPTest(t, LDAPConfig{
+			GroupAttribute: "none",
+			GroupBaseDN:    testGroupBase,
+			GroupFilter:    "(member={dn})",
+			GroupRoles:     roles[:1],
+			DefaultRole:    "readonly",
+		})
+
+		identity, err := ldapAuthenticator.Authenticate("alice", "alice-pass")
+		if err != nil || identity.Role != "admin" || len(identity.Groups) != 2 {
+			t.Errorf("alice: got %+v, %v", identity, err)
+		}
+		if identity, err := ldapAuthenticator.Authenticate("bob", "bob-pass"); err != nil || identity.Role != "readonly" {
+			t.Errorf("bob: got %+v, %v", identity, err)
+		}
+	})
+}
+
+func TestLDAPProvisioning(t *testing.T) {
+	t.Run("enabled", func(t *testing.T) {
+		setupLDAPTest(t, LDAPConfig{
+			Provision:  true,
+			GroupRoles: []LDAPGroupRole{{Group: "cn=nas-admins," + testGroupBase, Role: "admin"}},
+		})
+
+		user, err := authenticatePassword("alice", "alice-pass")
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, err := userStore.GetUser("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Source != UserSourceLDAP || stored.Source != UserSourceLDAP || stored.Role != "admin" || stored.Email != "alice@example.org" {
+			t.Errorf("provisioned %+v", stored)
+		}
+
+		// Later logins bring the account in line with the directory
+		stored.Role = "readonly"
+		stored.Email = "old@example.org"
+		if err := userStore.UpdateUser(stored); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := authenticatePassword("alice", "alice-pass"); err != nil {
+			t.Fatal(err)
+		}
+		if stored, _ := userStore.GetUser("alice"); stored.Role != "admin" || stored.Email != "alice@example.org" {
+			t.Errorf("after sync %+v", stored)
+		}
+
+		// The directory ignores case, so the same account must be used
+		if user, err := authenticatePassword("Alice", "alice-pass"); err != nil || user.Username != "alice" {
+			t.Errorf("mixed case login: got %+v, %v", user, err)
+		}
+		if users, _ := userStore.ListUsers(); len(users) != 1 {
+			t.Errorf("mixed case login left %d accounts", len(users))
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		directory := setupLDAPTest(t, LDAPConfig{})
+
+		if _, err := authenticatePassword("bob", "bob-pass"); !errors.Is(err, ErrLDAPInvalidCredentials) {
+			t.Errorf("unknown user: got %v, want invalid credentials", err)
+		}
+		if directory.dials != 0 {
+			t.Error("directory was asked about a user that cannot log in")
+		}
+
+		err := userStore.CreateUser(&User{Username: "bob", Role: "user", Source: UserSourceLDAP, Created: time.Now()}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := authenticatePassword("bob", "bob-pass"); err != nil {
+			t.Errorf("existing user: %v", err)
+		}
+	})
+
+	t.Run("local account", func(t *testing.T) {
+		setupLDAPTest(t, LDAPConfig{Provision: true})
+
+		hash, err := bcrypt.GenerateFromPassword([]byte("local-pass"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = userStore.CreateUser(&User{Username: "alice", Role: "admin", Source: UserSourceLocal, Created: time.Now()}, string(hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The directory password must not unlock a local account
+		if _, err := authenticatePassword("alice", "alice-pass"); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("directory password: got %v, want invalid credentials", err)
+		}
+		if user, err := authenticatePassword("alice", "local-pass"); err != nil || user.Source != UserSourceLocal {
+			t.Errorf("local password: got %+v, %v", user, err)
+		}
+	})
+}
+
+func TestLDAPUnreachable(t *testing.T) {
+	setupLDAPTest(t, LDAPConfig{Provision: true})
+	ldapAuthenticator.Dial = func() (LDAPConn, error) {
+		return nil, errors.New("connection refused")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("local-pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = userStore.CreateUser(&User{Username: "admin", Role: "admin", Source: UserSourceLocal, Created: time.Now()}, string(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = userStore.CreateUser(&User{Username: "bob", Role: "user", Source: UserSourceLDAP, Created: time.Now()}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.POST("/auth/login", Login)
+	login := func(username, password string) int {
+		body := `{"username":"` + username + `","password":"` + password + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/auth/login", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Local accounts do not depend on the directory
+	if code := login("admin", "local-pass"); code != http.StatusOK {
+		t.Errorf("local user: got %d, want 200", code)
+	}
+
+	// Directory users are turned away, but an outage is not held against
+	// them as failed attempts
+	for i := 0; i < 10; i++ {
+		if code := login("bob", "bob-pass"); code != http.StatusUnauthorized {
+			t.Fatalf("directory user: got %d, want 401", code)
+		}
+	}
+	if lockouts := loginLimiter.List(); len(lockouts) != 0 {
+		t.Errorf("outage counted as failures: %+v", lockouts)
+	}
+}
+
+func TestLDAPDisableTwoFactor(t *testing.T) {
+	setupLDAPTest(t, LDAPConfig{})
+
+	user := &User{Username: "bob", Role: "user", Source: UserSourceLDAP, Created: time.Now()}
+	if err := userStore.CreateUser(user, ""); err != nil {
+		t.Fatal(err)
+	}
+	key := enrollTwoFactor(t, user)
+	code := totpCode(key, time.Now().Unix()/totpPeriod)
+
+	r := gin.New()
+	r.POST("/user/2fa/disable", func(c *gin.Context) { c.Set("user", user) }, DisableTwoFactor)
+
+	// The password is checked against the directory, not the empty local
+	// hash
+	if w := postJSON(r, "/user/2fa/disable", `{"password":"wrong","code":"`+code+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password: got %d, want 401", w.Code)
+	}
+	if w := postJSON(r, "/user/2fa/disable", `{"code":"`+code+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("no password: got %d, want 401", w.Code)
+	}
+	if w := postJSON(r, "/user/2fa/disable", `{"password":"bob-pass","code":"`+code+`"}`); w.Code != http.StatusOK {
+		t.Errorf("directory password: got %d: %s", w.Code, w.Body)
+	}
+	if stored, _ := userStore.GetUser("bob"); stored.TwoFactorEnabled {
+		t.Error("2FA still enabled")
+	}
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultListLimit and maxListLimit bound the entries in a listing page
+	defaultListLimit = 500
+	maxListLimit     = 5000
+)
+
+// Orders a directory listing can be sorted in
+const (
+	SortByName    = "name"
+	SortBySize    = "size"
+	SortByModTime = "modTime"
+	SortByType    = "type"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ListOptions controls which entries of a directory are listed and in
+// what order. Folders always come before files.
+type ListOptions struct {
+	// Sort is one of the SortBy orders. Folders have no meaningful size or
+	// type, so those orders sort them by name.
+	Sort string
+	Desc bool
+	// Hidden includes entries whose names start with a dot
+	Hidden bool
+	// Pattern is a shell glob matched against names, ignoring case
+	Pattern string
+	Limit   int
+	// Cursor continues after the last entry of a previous page
+	Cursor *listCursor
+	// Visible, when set, hides folders for which it returns false
+	Visible func(path string) bool
+}
+
+// listEntry is a directory entry with what sorting needs. Entries are only
+// stat'ed up front when sorting by size or modification time.
+type listEntry struct {
+	name    string
+	isDir   bool
+	size    int64
+	modTime time.Time
+}
+
+// listCursor identifies the last entry of a page by its sort key, so that
+// entries added or removed meanwhile do not shift later pages
+type listCursor struct {
+	Sort    string `json:"s"`
+	Desc    bool   `json:"d,omitempty"`
+	Name    string `json:"n"`
+	IsDir   bool   `json:"f,omitempty"`
+	Size    int64  `json:"z,omitempty"`
+	ModTime int64  `json:"m,omitempty"`
+}
+
+// listDirectory returns one page of dir's entries, the number of entries
+// across all pages and the cursor for the next page, empty on the last
+func listDirectory(dir string, opts ListOptions) ([]listEntry, int, string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	dirEntries, err := f.ReadDir(-1)
+	f.Close()
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	pattern := strings.ToLower(opts.Pattern)
+	stat := opts.Sort == SortBySize || opts.Sort == SortByModTime
+
+	entries := make([]listEntry, 0, len(dirEntries))
+	for _, d := range dirEntries {
+		name := d.Name()
+		full := filepath.Join(dir, name)
+		if storage.IsReserved(full) {
+			continue
+		}
+		if !opts.Hidden && strings.HasPrefix(name, ".") {
+			continue
+		}
+		if pattern != "" {
+			if matched, _ := filepath.Match(pattern, strings.ToLower(name)); !matched {
+				continue
+			}
+		}
+		if d.IsDir() && opts.Visible != nil && !opts.Visible(full) {
+			continue
+		}
+
+		entry := listEntry{name: name, isDir: d.IsDir()}
+		if stat {
+			info, err := d.Info()
+			if err != nil {
+				// Removed since the directory was read
+				continue
+			}
+			entry.size, entry.modTime = info.Size(), info.ModTime()
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return opts.less(&entries[i], &entries[j]) })
+
+	start := 0
+	if opts.Cursor != nil {
+		after := opts.Cursor.entry()
+		start = sort.Search(len(entries), func(i int) bool { return opts.less(&after, &entries[i]) })
+	}
+	end := min(start+opts.Limit, len(entries))
+	page := entries[start:end]
+
+	next := ""
+	if end < len(entries) {
+		next = opts.cursorAfter(&page[len(page)-1])
+	}
+	return page, len(entries), next, nil
+}
+
+func (o ListOptions) less(a, b *listEntry) bool {
+	if a.isDir != b.isDir {
+		return a.isDir
+	}
+
+	c := 0
+	switch {
+	case o.Sort == SortByModTime:
+		c = a.modTime.Compare(b.modTime)
+	case o.Sort == SortBySize && !a.isDir:
+		c = cmp.Compare(a.size, b.size)
+	case o.Sort == SortByType && !a.isDir:
+		c = strings.Compare(strings.ToLower(filepath.Ext(a.name)), strings.ToLower(filepath.Ext(b.name)))
+	}
+	if c == 0 {
+		c = strings.Compare(strings.ToLower(a.name), strings.ToLower(b.name))
+	}
+	// Names are unique, which makes the order total
+	if c == 0 {
+		c = strings.Compare(a.name, b.name)
+	}
+
+	if o.Desc {
+		return c > 0
+	}
+	return c < 0
+}
+
+func (o ListOptions) cursorAfter(entry *listEntry) string {
+	cursor := listCursor{
+		Sort:  o.Sort,
+		Desc:  o.Desc,
+		Name:  entry.name,
+		IsDir: entry.isDir,
+		Size:  entry.size,
+	}
+	if !entry.modTime.IsZero() {
+		cursor.ModTime = entry.modTime.UnixNano()
+	}
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// parseListCursor decodes a cursor issued for the same sort order
+func parseListCursor(value string, opts ListOptions) (*listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var cursor listCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if cursor.Sort != opts.Sort || cursor.Desc != opts.Desc {
+		return nil, ErrInvalidCursor
+	}
+	return &cursor, nil
+}
+
+func (cursor *listCursor) entry() listEntry {
+	entry := listEntry{name: cursor.Name, isDir: cursor.IsDir, size: cursor.Size}
+	if cursor.ModTime != 0 {
+		entry.modTime = time.Unix(0, cursor.ModTime)
+	}
+	return entry
+}
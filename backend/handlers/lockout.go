@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LockoutPolicy controls when repeated failures start delaying a key
+type LockoutPolicy struct {
+	// FreeAttempts failures are allowed before any lockout applies
+	FreeAttempts int
+	// BaseDelay is the first lockout; each further failure doubles it
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// ResetAfter forgets failures once the key has been quiet this long
+	ResetAfter time.Duration
+}
+
+// attemptRecord tracks failures for a single username or client IP
+type attemptRecord struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+type Lockout struct {
+	Kind        string    `json:"kind"`
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"lastFailure"`
+	LockedUntil time.Time `json:"lockedUntil"`
+}
+
+// LoginLimiter applies exponential backoff to failed authentication attempts,
+// tracked independently per username and per client IP
+type LoginLimiter struct {
+	mu         sync.Mutex
+	userPolicy LockoutPolicy
+	ipPolicy   LockoutPolicy
+	users      map[string]*attemptRecord
+	ips        map[string]*attemptRecord
+}
+
+var (
+	loginLimiter *LoginLimiter
+	// resetLimiter throttles password reset emails. It is kept apart from
+	// loginLimiter so that requesting resets never locks anyone out.
+	resetLimiter *LoginLimiter
+	// shareLimiter throttles share password guesses per share and client,
+	// so that guessing one share locks neither the IP nor the share itself
+	shareLimiter *LoginLimiter
+)
+
+// SetLoginLimiter configures the limiter applied to auth entry points
+func SetLoginLimiter(limiter *LoginLimiter) {
+	loginLimiter = limiter
+}
+
+// SetResetLimiter configures the limiter applied to password reset requests
+func SetResetLimiter(limiter *LoginLimiter) {
+	resetLimiter = limiter
+}
+
+// SetShareLimiter configures the limiter applied to share passwords
+func SetShareLimiter(limiter *LoginLimiter) {
+	shareLimiter = limiter
+}
+
+// NewLoginLimiter returns a limiter with separate username and IP policies.
+// IPs usually get more free attempts since offices share one address.
+func NewLoginLimiter(userPolicy, ipPolicy LockoutPolicy) *LoginLimiter {
+	return &LoginLimiter{
+		userPolicy: userPolicy,
+		ipPolicy:   ipPolicy,
+		users:      make(map[string]*attemptRecord),
+		ips:        make(map[string]*attemptRecord),
+	}
+}
+
+// Check returns how long the caller must wait, or zero if it may try now
+func (l *LoginLimiter) Check(username, ip string) time.Duration {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var wait time.Duration
+	if record, exists := l.users[normalizeUsername(username)]; exists && username != "" {
+		wait = max(wait, record.lockedUntil.Sub(now))
+	}
+	if record, exists := l.ips[ip]; exists {
+		wait = max(wait, record.lockedUntil.Sub(now))
+	}
+	return max(wait, 0)
+}
+
+// Fail records a failed attempt; an empty username only counts against ip
+func (l *LoginLimiter) Fail(username, ip string) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if username != "" {
+		if record := fail(l.users, normalizeUsername(username), l.userPolicy, now); record.lockedUntil.After(now) {
+			log.Printf("Locked out user %q until %s after %d failures", username, record.lockedUntil.Format(time.RFC3339), record.failures)
+		}
+	}
+	if ip != "" {
+		if record := fail(l.ips, ip, l.ipPolicy, now); record.lockedUntil.After(now) {
+			log.Printf("Locked out %s until %s after %d failures", ip, record.lockedUntil.Format(time.RFC3339), record.failures)
+		}
+	}
+}
+
+// Succeed clears the failure history of username. The IP's is left to
+// expire, since whoever guesses from there could otherwise clear it by
+// signing in to an account of their own between attempts.
+func (l *LoginLimiter) Succeed(username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.users, normalizeUsername(username))
+}
+
+// UnlockUser clears a username's failures and reports whether any existed
+func (l *LoginLimiter) UnlockUser(username string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := normalizeUsername(username)
+	_, exists := l.users[key]
+	delete(l.users, key)
+	return exists
+}
+
+// UnlockIP clears an address's failures and reports whether any existed
+func (l *LoginLimiter) UnlockIP(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, exists := l.ips[ip]
+	delete(l.ips, ip)
+	return exists
+}
+
+// List returns all keys with recorded failures, locked ones first
+func (l *LoginLimiter) List() []Lockout {
+	l.mu.Lock()
+	list := make([]Lockout, 0, len(l.users)+len(l.ips))
+	for key, record := range l.users {
+		list = append(list, Lockout{"username", key, record.failures, record.lastFailure, record.lockedUntil})
+	}
+	for key, record := range l.ips {
+		list = append(list, Lockout{"ip", key, record.failures, record.lastFailure, record.lockedUntil})
+	}
+	l.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].LockedUntil.After(list[j].LockedUntil) })
+	return list
+}
+
+// Prune forgets records that have been quiet longer than their policy allows
+func (l *LoginLimiter) Prune() {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	prune(l.users, l.userPolicy, now)
+	prune(l.ips, l.ipPolicy, now)
+}
+
+// StartReaper prunes stale records every interval until stop is called
+func (l *LoginLimiter) StartReaper(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				l.Prune()
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+func fail(records map[string]*attemptRecord, key string, policy LockoutPolicy, now time.Time) *attemptRecord {
+	record, exists := records[key]
+	if !exists || now.Sub(record.lastFailure) > policy.ResetAfter {
+		record = &attemptRecord{}
+		records[key] = record
+	}
+
+	record.failures++
+	record.lastFailure = now
+	if over := record.failures - policy.FreeAttempts; over > 0 {
+		delay := time.Duration(float64(policy.BaseDelay) * math.Pow(2, float64(over-1)))
+		if delay > policy.MaxDelay || delay <= 0 {
+			delay = policy.MaxDelay
+		}
+		record.lockedUntil = now.Add(delay)
+	}
+	return record
+}
+
+func prune(records map[string]*attemptRecord, policy LockoutPolicy, now time.Time) {
+	for key, record := range records {
+		if now.After(record.lockedUntil) && now.Sub(record.lastFailure) > policy.ResetAfter {
+			delete(records, key)
+		}
+	}
+}
+
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// rejectIfLocked responds with 429 and Retry-After when the caller is
+// locked out, reporting whether it did so
+func rejectIfLocked(c *gin.Context, username string) bool {
+	return rejectIfLimited(c, loginLimiter, username, c.ClientIP())
+}
+
+// rejectIfLimited is rejectIfLocked for any limiter, with key in place of
+// the username
+func rejectIfLimited(c *gin.Context, limiter *LoginLimiter, key, ip string) bool {
+	wait := limiter.Check(key, ip)
+	if wait <= 0 {
+		return false
+	}
+
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":      "Too many failed attempts, try again later",
+		"retryAfter": seconds,
+	})
+	c.Abort()
+	return true
+}
+
+// GetLockouts lists usernames and addresses with recorded failures
+func GetLockouts(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"lockouts": loginLimiter.List()})
+}
+
+// UnlockLockout clears failures for ?username= or ?ip=
+func UnlockLockout(c *gin.Context) {
+	username, ip := c.Query("username"), c.Query("ip")
+
+	var found bool
+	switch {
+	case username != "":
+		found = loginLimiter.UnlockUser(username)
+	case ip != "":
+		found = loginLimiter.UnlockIP(ip)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username or ip required"})
+		return
+	}
+
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No lockout found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Lockout cleared successfully"})
+}
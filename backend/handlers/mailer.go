@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mailer delivers plain-text notification emails
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// LogMailer writes messages to the server log instead of sending them,
+// which is handy during development
+type LogMailer struct{}
+
+func (LogMailer) Send(to, subject, body string) error {
+	log.Printf("Mail to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+// SMTPMailer sends messages through an SMTP relay, using STARTTLS when the
+// server offers it
+type SMTPMailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (m SMTPMailer) Send(to, subject, body string) error {
+	// Header injection guard; addresses and subjects are single-line
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("invalid mail header")
+	}
+
+	msg := strings.Join([]string{
+		"From: " + m.From,
+		"To: " + to,
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		body,
+	}, "\r\n")
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	return smtp.SendMail(addr, auth, m.From, []string{to}, []byte(msg))
+}
+
+var mailer Mailer = LogMailer{}
+
+// SetMailer configures how notification emails are delivered
+func SetMailer(m Mailer) {
+	mailer = m
+}
@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// File categories reported in FileInfo
+const (
+	CategoryFolder   = "folder"
+	CategoryImage    = "image"
+	CategoryVideo    = "video"
+	CategoryAudio    = "audio"
+	CategoryDocument = "document"
+	CategoryArchive  = "archive"
+	CategoryCode     = "code"
+	CategoryText     = "text"
+	CategoryOther    = "other"
+)
+
+// mimeTypesByExtension maps lowercase extensions to MIME types. It takes
+// precedence over the system's mime.types so that results do not depend
+// on the host.
+var mimeTypesByExtension = map[string]string{
+	// Images
+	".jpg": "image/jpeg", ".jpeg": "image/jpeg", ".png": "image/png",
+	".gif": "image/gif", ".webp": "image/webp", ".bmp": "image/bmp",
+	".tif": "image/tiff", ".tiff": "image/tiff", ".svg": "image/svg+xml",
+	".ico": "image/vnd.microsoft.icon", ".heic": "image/heic", ".heif": "image/heif",
+	".avif": "image/avif", ".psd": "image/vnd.adobe.photoshop",
+	".raw": "image/x-raw", ".cr2": "image/x-canon-cr2", ".nef": "image/x-nikon-nef",
+	".arw": "image/x-sony-arw", ".dng": "image/x-adobe-dng",
+
+	// Video
+	".mp4": "video/mp4", ".m4v": "video/x-m4v", ".mkv": "video/x-matroska",
+	".webm": "video/webm", ".mov": "video/quicktime", ".avi": "video/x-msvideo",
+	".wmv": "video/x-ms-wmv", ".flv": "video/x-flv", ".mpg": "video/mpeg",
+	".mpeg": "video/mpeg", ".ts": "video/mp2t", ".m2ts": "video/mp2t",
+	".3gp": "video/3gpp", ".ogv": "video/ogg",
+
+	// Audio
+	".mp3": "audio/mpeg", ".m4a": "audio/mp4", ".aac": "audio/aac",
+	".flac": "audio/flac", ".wav": "audio/wav", ".ogg": "audio/ogg",
+	".oga": "audio/ogg", ".opus": "audio/opus", ".wma": "audio/x-ms-wma",
+	".aiff": "audio/aiff", ".mid": "audio/midi", ".midi": "audio/midi",
+
+	// Documents
+	".pdf":   "application/pdf",
+	".doc":   "application/msword",
+	".docx":  "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xls":   "application/vnd.ms-excel",
+	".xlsx":  "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".ppt":   "application/vnd.ms-powerpoint",
+	".pptx":  "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".odt":   "application/vnd.oasis.opendocument.text",
+	".ods":   "application/vnd.oasis.opendocument.spreadsheet",
+	".odp":   "application/vnd.oasis.opendocument.presentation",
+	".rtf":   "application/rtf",
+	".epub":  "application/epub+zip",
+	".pages": "application/vnd.apple.pages", ".numbers": "application/vnd.apple.numbers",
+	".key": "application/vnd.apple.keynote",
+
+	// Archives
+	".zip": "application/zip", ".tar": "application/x-tar", ".gz": "application/gzip",
+	".tgz": "application/gzip", ".bz2": "application/x-bzip2", ".xz": "application/x-xz",
+	".zst": "application/zstd", ".7z": "application/x-7z-compressed",
+	".rar": "application/vnd.rar", ".iso": "application/x-iso9660-image",
+	".dmg": "application/x-apple-diskimage",
+
+	// Text
+	".txt": "text/plain; charset=utf-8", ".md": "text/markdown; charset=utf-8",
+	".csv": "text/csv; charset=utf-8", ".tsv": "text/tab-separated-values; charset=utf-8",
+	".log": "text/plain; charset=utf-8", ".ini": "text/plain; charset=utf-8",
+	".conf": "text/plain; charset=utf-8", ".srt": "application/x-subrip",
+	".vtt": "text/vtt; charset=utf-8",
+
+	// Code and markup
+	".html": "text/html; charset=utf-8", ".htm": "text/html; charset=utf-8",
+	".css": "text/css; charset=utf-8", ".js": "text/javascript; charset=utf-8",
+	".mjs": "text/javascript; charset=utf-8", ".json": "application/json",
+	".xml": "application/xml", ".yaml": "application/yaml", ".yml": "application/yaml",
+	".toml": "application/toml", ".go": "text/x-go; charset=utf-8",
+	".py": "text/x-python; charset=utf-8", ".rb": "text/x-ruby; charset=utf-8",
+	".java": "text/x-java; charset=utf-8", ".c": "text/x-c; charset=utf-8",
+	".h": "text/x-c; charset=utf-8", ".cpp": "text/x-c++; charset=utf-8",
+	".hpp": "text/x-c++; charset=utf-8", ".cs": "text/x-csharp; charset=utf-8",
+	".rs": "text/x-rust; charset=utf-8", ".php": "text/x-php; charset=utf-8",
+	".swift": "text/x-swift; charset=utf-8", ".kt": "text/x-kotlin; charset=utf-8",
+	".sh": "application/x-sh", ".sql": "application/sql",
+	".tsx": "text/x-typescript; charset=utf-8", ".jsx": "text/javascript; charset=utf-8",
+	".vue": "text/x-vue; charset=utf-8",
+}
+
+// codeExtensions are categorized as code even when their MIME type is
+// plain text
+var codeExtensions = map[string]bool{
+	".go": true, ".py": true, ".rb": true, ".java": true, ".c": true, ".h": true,
+	".cpp": true, ".hpp": true, ".cs": true, ".rs": true, ".php": true,
+	".swift": true, ".kt": true, ".js": true, ".mjs": true, ".ts": true,
+	".tsx": true, ".jsx": true, ".vue": true, ".html": true, ".htm": true,
+	".css": true, ".json": true, ".xml": true, ".yaml": true, ".yml": true,
+	".toml": true, ".sh": true, ".sql": true,
+}
+
+// getMimeType returns the MIME type for a filename from its extension
+func getMimeType(filename string) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if mimeType, ok := mimeTypesByExtension[ext]; ok {
+		return mimeType
+	}
+	if mimeType := mime.TypeByExtension(ext); mimeType != "" {
+		return mimeType
+	}
+	return "application/octet-stream"
+}
+
+// detectMimeType returns the type of the file at path. Known extensions
+// are trusted, since opening every file in a large listing is expensive;
+// anything else is identified by its magic bytes.
+func detectMimeType(path string) string {
+	if mimeType := getMimeType(filepath.Base(path)); mimeType != "application/octet-stream" {
+		return mimeType
+	}
+
+	detected, err := mimetype.DetectFile(path)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return detected.String()
+}
+
+// sniffContentType determines the type of an open file from its content,
+// falling back to the extension when the content is inconclusive, e.g.
+// plain text that could be CSV or source code. The file offset is reset
+// afterwards.
+func sniffContentType(f *os.File, name string) (string, error) {
+	detected, err := mimetype.DetectReader(f)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	byExt := getMimeType(name)
+	if byExt == "application/octet-stream" {
+		return detected.String(), nil
+	}
+	// Content that is only recognized as a generic parent type, such as
+	// text/plain for Markdown or application/zip for EPUB, is better
+	// described by the extension
+	if detected.Is("application/octet-stream") || detected.Is("text/plain") || detected.Is("application/zip") {
+		return byExt, nil
+	}
+	return detected.String(), nil
+}
+
+// fileCategory groups a file into one of the broad categories shown by
+// the file manager
+func fileCategory(name, mimeType string) string {
+	mediaType, _, _ := mime.ParseMediaType(mimeType)
+	if mediaType == "" {
+		mediaType = mimeType
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		return CategoryImage
+	case strings.HasPrefix(mediaType, "video/"):
+		return CategoryVideo
+	case strings.HasPrefix(mediaType, "audio/"):
+		return CategoryAudio
+	}
+
+	switch mediaType {
+	case "application/zip", "application/x-tar", "application/gzip", "application/x-gzip",
+		"application/x-bzip2", "application/x-xz", "application/zstd",
+		"application/x-7z-compressed", "application/vnd.rar", "application/x-rar-compressed",
+		"application/x-iso9660-image", "application/x-apple-diskimage":
+		return CategoryArchive
+	case "application/pdf", "application/msword", "application/vnd.ms-excel",
+		"application/vnd.ms-powerpoint", "application/rtf", "text/rtf",
+		"application/epub+zip", "text/csv", "text/tab-separated-values":
+		return CategoryDocument
+	}
+	if strings.HasPrefix(mediaType, "application/vnd.openxmlformats-officedocument.") ||
+		strings.HasPrefix(mediaType, "application/vnd.oasis.opendocument.") ||
+		strings.HasPrefix(mediaType, "application/vnd.apple.") {
+		return CategoryDocument
+	}
+
+	if codeExtensions[strings.ToLower(filepath.Ext(name))] ||
+		mediaType == "application/json" || mediaType == "application/javascript" ||
+		mediaType == "text/javascript" || mediaType == "application/x-sh" {
+		return CategoryCode
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		return CategoryText
+	}
+	return CategoryOther
+}
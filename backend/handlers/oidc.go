@@ -0,0 +1,433 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcStateTTL = 10 * time.Minute
+	// oidcStateCookie binds a login's state to the browser that started it
+	oidcStateCookie = "nas_oidc_state"
+)
+
+var ErrOIDCAccountConflict = errors.New("account is not linked to this single sign-on identity")
+
+// OIDCClaimRole maps a value of the role claim to a local role
+type OIDCClaimRole struct {
+	Value string
+	Role  string
+}
+
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// UsernameClaim names the ID token claim used as the username of newly
+	// provisioned accounts; existing accounts are matched on issuer and sub
+	UsernameClaim string
+	// RoleClaim holds a string or list of strings matched against ClaimRoles
+	RoleClaim   string
+	ClaimRoles  []OIDCClaimRole
+	DefaultRole string
+	// Provision creates local accounts for unknown users on first login
+	Provision bool
+	// FrontendURL receives the session token, or the challenge to pass to
+	// VerifyLogin for users with 2FA, in its fragment after login; without
+	// it the callback responds with JSON like Login
+	FrontendURL string
+}
+
+// oidcLoginState is an authorization request waiting for its callback
+type oidcLoginState struct {
+	nonce    string
+	verifier string
+	expires  time.Time
+}
+
+// OIDCProvider runs the authorization-code flow with PKCE against a single
+// issuer. Discovery is deferred to the first login so that an unreachable
+// issuer does not prevent startup.
+type OIDCProvider struct {
+	config OIDCConfig
+
+	mu       sync.Mutex
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+	states   map[string]*oidcLoginState
+}
+
+var oidcProvider *OIDCProvider
+
+// SetOIDCProvider enables single sign-on; nil disables it
+func SetOIDCProvider(provider *OIDCProvider) {
+	oidcProvider = provider
+}
+
+// NewOIDCProvider returns a provider for config with defaults filled in
+func NewOIDCProvider(config OIDCConfig) *OIDCProvider {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{oidc.ScopeOpenID, "profile", "email"}
+	}
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "sub"
+	}
+	if config.RoleClaim == "" {
+		config.RoleClaim = "groups"
+	}
+	if config.DefaultRole == "" {
+		config.DefaultRole = "user"
+	}
+
+	return &OIDCProvider{
+		config: config,
+		states: make(map[string]*oidcLoginState),
+	}
+}
+
+// discover fetches the issuer metadata once and builds the OAuth2 client
+func (p *OIDCProvider) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.oauth != nil {
+		return p.oauth, p.verifier, nil
+	}
+
+	// The provider keeps this context for later key refreshes, so it must
+	// outlive the request that triggered discovery
+	client := &http.Client{Timeout: 10 * time.Second}
+	provider, err := oidc.NewProvider(oidc.ClientContext(context.WithoutCancel(ctx), client), p.config.Issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("discover issuer: %w", err)
+	}
+
+	p.oauth = &oauth2.Config{
+		ClientID:     p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		RedirectURL:  p.config.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       p.config.Scopes,
+	}
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.config.ClientID})
+	return p.oauth, p.verifier, nil
+}
+
+// saveState remembers a pending login and drops expired ones
+func (p *OIDCProvider) saveState(state string, pending *oidcLoginState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for key, s := range p.states {
+		if now.After(s.expires) {
+			delete(p.states, key)
+		}
+	}
+	p.states[state] = pending
+}
+
+// takeState returns and forgets a pending login; each state is single-use
+func (p *OIDCProvider) takeState(state string) (*oidcLoginState, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pending, exists := p.states[state]
+	delete(p.states, state)
+	if !exists || time.Now().After(pending.expires) {
+		return nil, false
+	}
+	return pending, true
+}
+
+// setStateCookie stores state in the browser, scoped to the callback. Lax
+// cookies still come along on the identity provider's redirect back.
+func (p *OIDCProvider) setStateCookie(c *gin.Context, state string, maxAge int) {
+	path := "/"
+	if u, err := url.Parse(p.config.RedirectURL); err == nil && u.Path != "" {
+		path = u.Path
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state, maxAge, path, "", c.Request.TLS != nil, true)
+}
+
+// identity extracts the subject, local username, email and role from ID
+// token claims
+func (p *OIDCProvider) identity(claims map[string]interface{}) (*ExternalIdentity, error) {
+	issuer, _ := claims["iss"].(string)
+	subject, _ := claims["sub"].(string)
+	if issuer == "" || subject == "" {
+		return nil, errors.New("ID token has no issuer or subject")
+	}
+
+	username, _ := claims[p.config.UsernameClaim].(string)
+	if username == "" {
+		username = subject
+	}
+
+	email, _ := claims["email"].(string)
+
+	var values []string
+	switch v := claims[p.config.RoleClaim].(type) {
+	case string:
+		values = []string{v}
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	role := p.config.DefaultRole
+mapping:
+	for _, m := range p.config.ClaimRoles {
+		for _, value := range values {
+			if value == m.Value {
+				role = m.Role
+				break mapping
+			}
+		}
+	}
+
+	return &ExternalIdentity{
+		Username: username,
+		Email:    email,
+		Role:     role,
+		Groups:   values,
+		Issuer:   issuer,
+		Subject:  subject,
+	}, nil
+}
+
+// OIDCLogin redirects the browser to the identity provider
+func OIDCLogin(c *gin.Context) {
+	if oidcProvider == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Single sign-on is not configured"})
+		return
+	}
+
+	oauthConfig, _, err := oidcProvider.discover(c.Request.Context())
+	if err != nil {
+		log.Printf("OIDC discovery failed: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider unavailable"})
+		return
+	}
+
+	state, err := generateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate state"})
+		return
+	}
+	nonce, err := generateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate nonce"})
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	oidcProvider.saveState(state, &oidcLoginState{
+		nonce:    nonce,
+		verifier: verifier,
+		expires:  time.Now().Add(oidcStateTTL),
+	})
+	oidcProvider.setStateCookie(c, state, int(oidcStateTTL.Seconds()))
+
+	c.Redirect(http.StatusFound, oauthConfig.AuthCodeURL(state,
+		oauth2.S256ChallengeOption(verifier),
+		oidc.Nonce(nonce),
+	))
+}
+
+// OIDCCallback exchanges the authorization code, verifies the ID token and
+// starts a session for the mapped local user
+func OIDCCallback(c *gin.Context) {
+	if oidcProvider == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Single sign-on is not configured"})
+		return
+	}
+
+	// A callback carrying a state this browser did not start could log it
+	// into an attacker's account
+	state := c.Query("state")
+	cookie, _ := c.Cookie(oidcStateCookie)
+	oidcProvider.setStateCookie(c, "", -1)
+
+	if errCode := c.Query("error"); errCode != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error":       "Single sign-on failed",
+			"description": c.Query("error_description"),
+		})
+		return
+	}
+
+	if rejectIfLocked(c, "") {
+		return
+	}
+
+	if cookie == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(state)) != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired login state"})
+		return
+	}
+	pending, ok := oidcProvider.takeState(state)
+	if !ok {
+		loginLimiter.Fail("", c.ClientIP())
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired login state"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	oauthConfig, verifier, err := oidcProvider.discover(ctx)
+	if err != nil {
+		log.Printf("OIDC discovery failed: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider unavailable"})
+		return
+	}
+
+	oauthToken, err := oauthConfig.Exchange(ctx, c.Query("code"), oauth2.VerifierOption(pending.verifier))
+	if err != nil {
+		log.Printf("OIDC code exchange failed: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Single sign-on failed"})
+		return
+	}
+
+	rawIDToken, ok := oauthToken.Extra("id_token").(string)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Identity provider returned no ID token"})
+		return
+	}
+
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil || idToken.Nonce != pending.nonce {
+		log.Printf("OIDC ID token rejected: %v", err)
+		loginLimiter.Fail("", c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid ID token"})
+		return
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid ID token"})
+		return
+	}
+
+	identity, err := oidcProvider.identity(claims)
+	if err != nil {
+		log.Printf("OIDC identity mapping failed: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Single sign-on failed"})
+		return
+	}
+
+	user, err := syncOIDCUser(identity)
+	if err != nil {
+		if errors.Is(err, ErrOIDCAccountConflict) || errors.Is(err, ErrUserNotFound) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "No single sign-on account for this user"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user"})
+		return
+	}
+
+	// The identity provider stands in for the password only; users with
+	// 2FA still confirm a code via VerifyLogin
+	if user.TwoFactorEnabled {
+		challenge, err := newLoginChallenge(user)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+			return
+		}
+		if oidcProvider.config.FrontendURL == "" {
+			c.JSON(http.StatusOK, gin.H{
+				"twoFactorRequired": true,
+				"challenge":         challenge,
+			})
+			return
+		}
+		oidcProvider.redirectToFrontend(c, "challenge", challenge)
+		return
+	}
+
+	if oidcProvider.config.FrontendURL == "" {
+		completeLogin(c, user)
+		return
+	}
+
+	token, err := startSession(c, user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	oidcProvider.redirectToFrontend(c, "token", token)
+}
+
+// redirectToFrontend hands a login result to the frontend in the URL
+// fragment, which never reaches server logs or Referer headers
+func (p *OIDCProvider) redirectToFrontend(c *gin.Context, key, value string) {
+	target := strings.TrimSuffix(p.config.FrontendURL, "#") + "#" + key + "=" + url.QueryEscape(value)
+	c.Redirect(http.StatusFound, target)
+}
+
+// syncOIDCUser returns the local account for identity, provisioning it or
+// refreshing its email and role as configured. Accounts are found by issuer
+// and subject; an account found by username is only linked if it is not yet
+// bound to another subject.
+func syncOIDCUser(identity *ExternalIdentity) (*User, error) {
+	existing, err := userStore.GetUserBySubject(identity.Issuer, identity.Subject)
+	if errors.Is(err, ErrUserNotFound) {
+		existing, err = userStore.GetUser(identity.Username)
+	}
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return nil, err
+	}
+
+	if existing == nil {
+		if !oidcProvider.config.Provision {
+			return nil, ErrUserNotFound
+		}
+		user := &User{
+			Username: identity.Username,
+			Email:    identity.Email,
+			Role:     identity.Role,
+			Source:   UserSourceOIDC,
+			Created:  time.Now(),
+			Issuer:   identity.Issuer,
+			Subject:  identity.Subject,
+		}
+		if err := userStore.CreateUser(user, ""); err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+
+	if existing.Source != UserSourceOIDC {
+		return nil, ErrOIDCAccountConflict
+	}
+	if existing.Subject != "" && (existing.Subject != identity.Subject || existing.Issuer != identity.Issuer) {
+		return nil, ErrOIDCAccountConflict
+	}
+
+	if existing.Email != identity.Email || existing.Role != identity.Role || existing.Subject == "" {
+		existing.Email = identity.Email
+		existing.Role = identity.Role
+		existing.Issuer = identity.Issuer
+		existing.Subject = identity.Subject
+		if err := userStore.UpdateUser(existing); err != nil {
+			return nil, err
+		}
+	}
+	return existing, nil
+}
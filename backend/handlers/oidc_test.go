@@ -0,0 +1,436 @@
+package handlers
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	testClientID    = "nas"
+	testRedirectURL = "http://nas.test/auth/oidc/callback"
+	testAuthCode    = "good-code"
+)
+
+// mockIssuer is a minimal OpenID provider serving discovery, keys and a
+// token endpoint that answers testAuthCode with an ID token for claims
+type mockIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]interface{}
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeTestJSON(w, map[string]interface{}{
+			"issuer":                                m.server.URL,
+			"authorization_endpoint":                m.server.URL + "/authorize",
+			"token_endpoint":                        m.server.URL + "/token",
+			"jwks_uri":                              m.server.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		writeTestJSON(w, map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != testAuthCode || r.FormValue("code_verifier") == "" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		writeTestJSON(w, map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     m.idToken(t),
+		})
+	})
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+// idToken signs the current claims, filling in the registered ones
+func (m *mockIssuer) idToken(t *testing.T) string {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": m.server.URL,
+		"aud": testClientID,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+	for k, v := range m.claims {
+		claims[k] = v
+	}
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"test","typ":"JWT"}`))
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Error(err)
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Error(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeTestJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// setupAuthTest points the user store, sessions and login limiter at a
+// fresh database
+func setupAuthTest(t *testing.T) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	store, err := NewBoltUserStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetUserStore(store)
+	sessions, err := NewSessionManager(db, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetSessionManager(sessions)
+	policy := LockoutPolicy{FreeAttempts: 5, BaseDelay: time.Second, MaxDelay: time.Minute, ResetAfter: time.Minute}
+	SetLoginLimiter(NewLoginLimiter(policy, policy))
+}
+
+// enrollTwoFactor turns on 2FA for user and returns its TOTP key
+func enrollTwoFactor(t *testing.T, user *User) []byte {
+	t.Helper()
+
+	key := []byte("12345678901234567890")
+	if err := userStore.SetTwoFactor(user.Username, &TwoFactorSecrets{Secret: base32NoPadding.EncodeToString(key)}); err != nil {
+		t.Fatal(err)
+	}
+	user.TwoFactorEnabled = true
+	if err := userStore.UpdateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// postJSON sends body to path on r
+func postJSON(r *gin.Engine, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// setupOIDCTest prepares the package as setupAuthTest does, configures the
+// mock issuer and returns a router serving the login endpoints
+func setupOIDCTest(t *testing.T, config OIDCConfig) (*mockIssuer, *gin.Engine) {
+	t.Helper()
+	setupAuthTest(t)
+
+	issuer := newMockIssuer(t)
+	config.Issuer = issuer.server.URL
+	config.ClientID = testClientID
+	config.RedirectURL = testRedirectURL
+	SetOIDCProvider(NewOIDCProvider(config))
+	t.Cleanup(func() { SetOIDCProvider(nil) })
+
+	r := gin.New()
+	r.GET("/auth/oidc/login", OIDCLogin)
+	r.GET("/auth/oidc/callback", OIDCCallback)
+	return issuer, r
+}
+
+// startOIDCLogin runs OIDCLogin and returns the state and nonce sent to the
+// issuer along with the state cookie set in the browser
+func startOIDCLogin(t *testing.T, r *gin.Engine) (state, nonce string, cookie *http.Cookie) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/oidc/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: got %d: %s", w.Code, w.Body)
+	}
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := location.Query()
+	if query.Get("code_challenge") == "" {
+		t.Error("login: no PKCE challenge")
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == oidcStateCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Value != query.Get("state") {
+		t.Fatalf("login: state cookie %v does not match state %q", cookie, query.Get("state"))
+	}
+	return query.Get("state"), query.Get("nonce"), cookie
+}
+
+func oidcCallback(r *gin.Engine, state, code string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/auth/oidc/callback?"+url.Values{
+		"state": {state},
+		"code":  {code},
+	}.Encode(), nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestOIDCLoginProvisionsUser(t *testing.T) {
+	issuer, r := setupOIDCTest(t, OIDCConfig{
+		UsernameClaim: "preferred_username",
+		Provision:     true,
+		ClaimRoles:    []OIDCClaimRole{{Value: "nas-admins", Role: "admin"}},
+	})
+
+	state, nonce, cookie := startOIDCLogin(t, r)
+	issuer.claims = map[string]interface{}{
+		"sub":                "1234",
+		"nonce":              nonce,
+		"preferred_username": "alice",
+		"email":              "alice@example.com",
+		"groups":             []string{"staff", "nas-admins"},
+	}
+
+	w := oidcCallback(r, state, testAuthCode, cookie)
+	if w.Code != http.StatusOK {
+		t.Fatalf("callback: got %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Token == "" {
+		t.Fatalf("callback: no session token in %s", w.Body)
+	}
+
+	user, err := userStore.GetUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Source != UserSourceOIDC || user.Role != "admin" || user.Email != "alice@example.com" {
+		t.Errorf("provisioned %+v", user)
+	}
+	if user.Issuer != issuer.server.URL || user.Subject != "1234" {
+		t.Errorf("provisioned %+v without its subject", user)
+	}
+
+	// Each state can only be used once
+	if w := oidcCallback(r, state, testAuthCode, cookie); w.Code != http.StatusBadRequest {
+		t.Errorf("replayed callback: got %d, want 400", w.Code)
+	}
+}
+
+func TestOIDCCallbackRequiresStateCookie(t *testing.T) {
+	issuer, r := setupOIDCTest(t, OIDCConfig{Provision: true})
+
+	state, nonce, _ := startOIDCLogin(t, r)
+	issuer.claims = map[string]interface{}{"sub": "bob", "nonce": nonce}
+
+	if w := oidcCallback(r, state, testAuthCode, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("without cookie: got %d, want 400", w.Code)
+	}
+
+	// A cookie from a login started elsewhere does not match
+	_, _, other := startOIDCLogin(t, r)
+	if w := oidcCallback(r, state, testAuthCode, other); w.Code != http.StatusBadRequest {
+		t.Errorf("with another login's cookie: got %d, want 400", w.Code)
+	}
+	if _, err := userStore.GetUser("bob"); err == nil {
+		t.Error("user was provisioned by a rejected callback")
+	}
+}
+
+func TestOIDCCallbackRejectsWrongNonce(t *testing.T) {
+	issuer, r := setupOIDCTest(t, OIDCConfig{Provision: true})
+
+	state, _, cookie := startOIDCLogin(t, r)
+	issuer.claims = map[string]interface{}{"sub": "carol", "nonce": "replayed"}
+
+	if w := oidcCallback(r, state, testAuthCode, cookie); w.Code != http.StatusUnauthorized {
+		t.Errorf("got %d, want 401", w.Code)
+	}
+}
+
+func TestOIDCCallbackRejectsBadCode(t *testing.T) {
+	_, r := setupOIDCTest(t, OIDCConfig{Provision: true})
+
+	state, _, cookie := startOIDCLogin(t, r)
+	if w := oidcCallback(r, state, "forged", cookie); w.Code != http.StatusUnauthorized {
+		t.Errorf("got %d, want 401", w.Code)
+	}
+}
+
+func TestOIDCWithoutProvisioning(t *testing.T) {
+	issuer, r := setupOIDCTest(t, OIDCConfig{})
+
+	state, nonce, cookie := startOIDCLogin(t, r)
+	issuer.claims = map[string]interface{}{"sub": "dave", "nonce": nonce}
+	if w := oidcCallback(r, state, testAuthCode, cookie); w.Code != http.StatusForbidden {
+		t.Fatalf("unknown user: got %d, want 403", w.Code)
+	}
+	if _, err := userStore.GetUser("dave"); err == nil {
+		t.Fatal("user was provisioned with provisioning off")
+	}
+
+	// Accounts created beforehand can still sign in
+	err := userStore.CreateUser(&User{Username: "dave", Role: "readonly", Source: UserSourceOIDC, Created: time.Now()}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, nonce, cookie = startOIDCLogin(t, r)
+	issuer.claims = map[string]interface{}{"sub": "dave", "nonce": nonce}
+	if w := oidcCallback(r, state, testAuthCode, cookie); w.Code != http.StatusOK {
+		t.Errorf("existing user: got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestOIDCMatchesSubject(t *testing.T) {
+	issuer, r := setupOIDCTest(t, OIDCConfig{UsernameClaim: "preferred_username", Provision: true})
+
+	login := func(claims map[string]interface{}) *httptest.ResponseRecorder {
+		state, nonce, cookie := startOIDCLogin(t, r)
+		claims["nonce"] = nonce
+		issuer.claims = claims
+		return oidcCallback(r, state, testAuthCode, cookie)
+	}
+
+	if w := login(map[string]interface{}{"sub": "1234", "preferred_username": "frank"}); w.Code != http.StatusOK {
+		t.Fatalf("first login: got %d: %s", w.Code, w.Body)
+	}
+
+	// A changed username still signs in to the same account
+	if w := login(map[string]interface{}{"sub": "1234", "preferred_username": "franklin"}); w.Code != http.StatusOK {
+		t.Fatalf("renamed login: got %d: %s", w.Code, w.Body)
+	}
+	if _, err := userStore.GetUser("franklin"); err == nil {
+		t.Error("renamed login provisioned a second account")
+	}
+
+	// Another subject claiming the same username is refused
+	if w := login(map[string]interface{}{"sub": "5678", "preferred_username": "frank"}); w.Code != http.StatusForbidden {
+		t.Errorf("other subject: got %d, want 403", w.Code)
+	}
+}
+
+func TestOIDCRejectsLocalAccount(t *testing.T) {
+	issuer, r := setupOIDCTest(t, OIDCConfig{Provision: true})
+
+	err := userStore.CreateUser(&User{Username: "admin", Role: "admin", Source: UserSourceLocal, Created: time.Now()}, "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, nonce, cookie := startOIDCLogin(t, r)
+	issuer.claims = map[string]interface{}{"sub": "admin", "nonce": nonce}
+	if w := oidcCallback(r, state, testAuthCode, cookie); w.Code != http.StatusForbidden {
+		t.Errorf("got %d, want 403", w.Code)
+	}
+}
+
+func TestOIDCTwoFactor(t *testing.T) {
+	issuer, r := setupOIDCTest(t, OIDCConfig{})
+	r.POST("/auth/2fa/verify", VerifyLogin)
+
+	user := &User{Username: "erin", Role: "user", Source: UserSourceOIDC, Created: time.Now()}
+	if err := userStore.CreateUser(user, ""); err != nil {
+		t.Fatal(err)
+	}
+	key := enrollTwoFactor(t, user)
+	step := time.Now().Unix() / totpPeriod
+
+	state, nonce, cookie := startOIDCLogin(t, r)
+	issuer.claims = map[string]interface{}{"sub": "erin", "nonce": nonce}
+	w := oidcCallback(r, state, testAuthCode, cookie)
+	var resp struct {
+		Token             string `json:"token"`
+		TwoFactorRequired bool   `json:"twoFactorRequired"`
+		Challenge         string `json:"challenge"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || resp.Token != "" || !resp.TwoFactorRequired || resp.Challenge == "" {
+		t.Fatalf("callback: got %d: %s", w.Code, w.Body)
+	}
+
+	w = postJSON(r, "/auth/2fa/verify", `{"challenge":"`+resp.Challenge+`","code":"`+totpCode(key, step)+`"}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"token"`) {
+		t.Fatalf("verify: got %d: %s", w.Code, w.Body)
+	}
+
+	// Without a password to confirm, the code alone turns 2FA off
+	r.POST("/user/2fa/disable", func(c *gin.Context) { c.Set("user", user) }, DisableTwoFactor)
+	if w := postJSON(r, "/user/2fa/disable", `{"code":"`+totpCode(key, step+1)+`"}`); w.Code != http.StatusOK {
+		t.Errorf("disable: got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestOIDCTwoFactorRedirect(t *testing.T) {
+	issuer, r := setupOIDCTest(t, OIDCConfig{FrontendURL: "http://app.test/login"})
+
+	user := &User{Username: "erin", Role: "user", Source: UserSourceOIDC, Created: time.Now()}
+	if err := userStore.CreateUser(user, ""); err != nil {
+		t.Fatal(err)
+	}
+	enrollTwoFactor(t, user)
+
+	state, nonce, cookie := startOIDCLogin(t, r)
+	issuer.claims = map[string]interface{}{"sub": "erin", "nonce": nonce}
+	w := oidcCallback(r, state, testAuthCode, cookie)
+	location := w.Header().Get("Location")
+	if w.Code != http.StatusFound || !strings.HasPrefix(location, "http://app.test/login#challenge=") {
+		t.Errorf("got %d to %q, want a redirect with the challenge", w.Code, location)
+	}
+}
@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	passwordResetTTL = time.Hour
+	// forgotPasswordDelay is how long every reset request takes to answer,
+	// whether or not the account exists
+	forgotPasswordDelay = 500 * time.Millisecond
+)
+
+var ErrResetTokenInvalid = errors.New("invalid or expired reset token")
+
+var passwordResetsBucket = []byte("password_resets")
+
+type ChangePasswordRequest struct {
+	OldPassword string `json:"oldPassword" binding:"required"`
+	NewPassword string `json:"newPassword" binding:"required,min=6"`
+}
+
+type ForgotPasswordRequest struct {
+	Username string `json:"username" binding:"required"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,min=6"`
+}
+
+// passwordReset is a pending one-time reset, stored under the token hash
+type passwordReset struct {
+	Username string    `json:"username"`
+	Expires  time.Time `json:"expires"`
+}
+
+// PasswordResetStore persists one-time password reset tokens
+type PasswordResetStore struct {
+	db *bolt.DB
+	// resetURL is the frontend page that accepts ?token=
+	resetURL string
+}
+
+var passwordResetStore *PasswordResetStore
+
+// SetPasswordResetStore configures the store used by the reset flow
+func SetPasswordResetStore(store *PasswordResetStore) {
+	passwordResetStore = store
+}
+
+// NewPasswordResetStore creates the reset bucket if needed. Links in reset
+// emails point at resetURL with the token appended as a query parameter.
+func NewPasswordResetStore(db *bolt.DB, resetURL string) (*PasswordResetStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(passwordResetsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PasswordResetStore{db: db, resetURL: resetURL}, nil
+}
+
+// Create issues a reset token for username, replacing any earlier ones
+func (s *PasswordResetStore) Create(username string) (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(passwordReset{
+		Username: username,
+		Expires:  time.Now().Add(passwordResetTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(passwordResetsBucket)
+		if err := deleteResets(b, func(r *passwordReset) bool { return r.Username == username }); err != nil {
+			return err
+		}
+		return b.Put([]byte(hashToken(token)), data)
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Consume validates token and deletes it, returning the username it was for
+func (s *PasswordResetStore) Consume(token string) (string, error) {
+	key := []byte(hashToken(token))
+
+	var reset passwordReset
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(passwordResetsBucket)
+		data := b.Get(key)
+		if data == nil {
+			return ErrResetTokenInvalid
+		}
+		if err := json.Unmarshal(data, &reset); err != nil {
+			return err
+		}
+		if err := b.Delete(key); err != nil {
+			return err
+		}
+
+		// Drop other expired tokens while we are here
+		now := time.Now()
+		return deleteResets(b, func(r *passwordReset) bool { return now.After(r.Expires) })
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if time.Now().After(reset.Expires) {
+		return "", ErrResetTokenInvalid
+	}
+	return reset.Username, nil
+}
+
+// Link returns the URL emailed to the user for token
+func (s *PasswordResetStore) Link(token string) string {
+	return s.resetURL + "?token=" + url.QueryEscape(token)
+}
+
+func deleteResets(b *bolt.Bucket, match func(*passwordReset) bool) error {
+	var keys [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		var reset passwordReset
+		if err := json.Unmarshal(v, &reset); err != nil {
+			return err
+		}
+		if match(&reset) {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setPassword hashes and stores a new password for a local account
+func setPassword(user *User, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return userStore.SetPasswordHash(user.Username, string(hashedPassword))
+}
+
+// ChangePassword lets the current user change their own password
+func ChangePassword(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if user.Source != UserSourceLocal {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password is managed by an external directory"})
+		return
+	}
+
+	if rejectIfLocked(c, user.Username) {
+		return
+	}
+
+	hash, err := userStore.GetPasswordHash(user.Username)
+	if err != nil || bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.OldPassword)) != nil {
+		loginLimiter.Fail(user.Username, c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+
+	if err := setPassword(user, req.NewPassword); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
+		return
+	}
+
+	// Sign out everywhere else; the caller keeps its current session
+	keep := ""
+	if session, ok := c.Get("session"); ok {
+		keep = session.(*Session).ID
+	}
+	sessionManager.RevokeUserExcept(user.ID, keep)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed successfully"})
+}
+
+// ForgotPassword emails a one-time reset link. It answers the same way
+// whether or not the account exists so that usernames cannot be probed.
+func ForgotPassword(c *gin.Context) {
+	var req ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Every request counts against the username and address so this cannot
+	// be used to flood mailboxes
+	if rejectIfLimited(c, resetLimiter, req.Username, c.ClientIP()) {
+		return
+	}
+	resetLimiter.Fail(req.Username, c.ClientIP())
+
+	// Looking the account up and mailing it happen in the background, so
+	// neither the response nor its timing tells whether it exists
+	go sendPasswordReset(req.Username)
+	time.Sleep(forgotPasswordDelay)
+
+	c.JSON(http.StatusOK, gin.H{"message": "If the account exists, a reset link has been sent"})
+}
+
+// sendPasswordReset mails a reset link to username if it is a local
+// account with an email address
+func sendPasswordReset(username string) {
+	user, err := userStore.GetUser(username)
+	if err != nil || user.Source != UserSourceLocal || user.Email == "" {
+		return
+	}
+
+	token, err := passwordResetStore.Create(user.Username)
+	if err != nil {
+		log.Printf("Failed to create password reset token for %s: %v", user.Username, err)
+		return
+	}
+
+	body := fmt.Sprintf("Hello %s,\n\n"+
+		"Someone requested a password reset for your NAS OS account.\n"+
+		"Open the link below within %d minutes to choose a new password:\n\n"+
+		"%s\n\n"+
+		"If you did not request this, you can ignore this email.\n",
+		user.Username, int(passwordResetTTL.Minutes()), passwordResetStore.Link(token))
+
+	if err := mailer.Send(user.Email, "NAS OS password reset", body); err != nil {
+		log.Printf("Failed to send password reset email to %s: %v", user.Username, err)
+	}
+}
+
+// ResetPassword sets a new password using a token from ForgotPassword
+func ResetPassword(c *gin.Context) {
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if rejectIfLocked(c, "") {
+		return
+	}
+
+	username, err := passwordResetStore.Consume(req.Token)
+	if err != nil {
+		if errors.Is(err, ErrResetTokenInvalid) {
+			loginLimiter.Fail("", c.ClientIP())
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	user, err := userStore.GetUser(username)
+	if err != nil || user.Source != UserSourceLocal {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+
+	if err := setPassword(user, req.Password); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	sessionManager.RevokeUser(user.ID)
+	loginLimiter.UnlockUser(user.Username)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset successfully"})
+}
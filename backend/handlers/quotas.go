@@ -0,0 +1,692 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Quota principals
+const (
+	QuotaKindUser  = "user"
+	QuotaKindGroup = "group"
+)
+
+var ErrQuotaNotFound = errors.New("quota not found")
+
+var (
+	quotasBucket     = []byte("quotas")
+	fileOwnersBucket = []byte("file_owners")
+)
+
+// Quota limits the bytes a user, or all members of a group together, may
+// own on a volume. Either limit may be zero for none. Going over the soft
+// limit is allowed but reported; the hard limit refuses the write.
+type Quota struct {
+	Kind   string `json:"kind" binding:"required,oneof=user group"`
+	Name   string `json:"name" binding:"required"`
+	Volume string `json:"volume" binding:"required"`
+	Soft   int64  `json:"soft" binding:"min=0"`
+	Hard   int64  `json:"hard" binding:"min=0"`
+}
+
+// QuotaUsage is a quota together with what is currently charged to it
+type QuotaUsage struct {
+	Quota
+	Used         int64 `json:"used"`
+	SoftExceeded bool  `json:"softExceeded"`
+	HardExceeded bool  `json:"hardExceeded"`
+}
+
+// VolumeUsage is the bytes a user owns on a volume
+type VolumeUsage struct {
+	Username string `json:"username,omitempty"`
+	Volume   string `json:"volume"`
+	Used     int64  `json:"used"`
+}
+
+// QuotaExceededError is returned when a write would go over a hard limit
+type QuotaExceededError struct {
+	Usage QuotaUsage
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s quota for %s on %s exceeded", e.Usage.Kind, e.Usage.Name, e.Usage.Volume)
+}
+
+// fileOwner records who a file is charged to
+type fileOwner struct {
+	Owner string `json:"owner"`
+	Size  int64  `json:"size"`
+}
+
+// quotaReservation holds space for a write that is still in progress
+type quotaReservation struct {
+	volume   string
+	username string
+	size     int64
+}
+
+// QuotaManager charges files to the users who wrote them and checks
+// writes against quotas. Ownership is recorded per canonical path and
+// follows files through moves and the trash; usage totals are kept in
+// memory.
+type QuotaManager struct {
+	mu     sync.Mutex
+	db     *bolt.DB
+	quotas map[string]Quota
+	// usage maps volume to username to bytes
+	usage map[string]map[string]int64
+	// reserved holds space promised to writes in progress, by key, which
+	// counts as used until the write is charged and the key released
+	reserved map[string]quotaReservation
+}
+
+var quotaManager *QuotaManager
+
+// SetQuotaManager configures the manager used to account for writes
+func SetQuotaManager(manager *QuotaManager) {
+	quotaManager = manager
+}
+
+// NewQuotaManager loads quotas and totals the recorded file owners
+func NewQuotaManager(db *bolt.DB) (*QuotaManager, error) {
+	m := &QuotaManager{
+		db:     db,
+		quotas:   make(map[string]Quota),
+		usage:    make(map[string]map[string]int64),
+		reserved: make(map[string]quotaReservation),
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		quotas, err := tx.CreateBucketIfNotExists(quotasBucket)
+		if err != nil {
+			return err
+		}
+		err = quotas.ForEach(func(k, v []byte) error {
+			var quota Quota
+			if err := json.Unmarshal(v, &quota); err != nil {
+				return err
+			}
+			m.quotas[string(k)] = quota
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		owners, err := tx.CreateBucketIfNotExists(fileOwnersBucket)
+		if err != nil {
+			return err
+		}
+		return owners.ForEach(func(k, v []byte) error {
+			var owner fileOwner
+			if err := json.Unmarshal(v, &owner); err != nil {
+				return err
+			}
+			m.add(volumeOf(string(k)), owner.Owner, owner.Size)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Check reports whether username may write size more bytes at path. It
+// fails with a QuotaExceededError when that would go over a hard limit and
+// returns soft when a soft limit would be passed. Bytes already charged to
+// username at path, which the write replaces, are not counted twice.
+func (m *QuotaManager) Check(username, path string, size int64) (soft bool, err error) {
+	size, err = m.replacing(username, path, size)
+	if err != nil {
+		return false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.check(username, volumeOf(path), size)
+}
+
+// Reserve checks a write like Check and, if it may go ahead, holds the
+// space for it under key until Release, so that concurrent writes cannot
+// be promised the same space. Reserving an existing key again replaces
+// its reservation, which lets a write grow its own.
+func (m *QuotaManager) Reserve(key, username, path string, size int64) (soft bool, err error) {
+	size, err = m.replacing(username, path, size)
+	if err != nil {
+		return false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	previous, held := m.reserved[key]
+	delete(m.reserved, key)
+	volume := volumeOf(path)
+	if soft, err = m.check(username, volume, size); err != nil {
+		if held {
+			m.reserved[key] = previous
+		}
+		return false, err
+	}
+	if size > 0 {
+		m.reserved[key] = quotaReservation{volume: volume, username: username, size: size}
+	}
+	return soft, nil
+}
+
+// Release gives up the space reserved under key
+func (m *QuotaManager) Release(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.reserved, key)
+}
+
+// replacing returns the bytes a write of size at path adds for username,
+// which is less when it replaces a file already charged to them
+func (m *QuotaManager) replacing(username, path string, size int64) (int64, error) {
+	var replaced fileOwner
+	err := m.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(fileOwnersBucket).Get([]byte(path)); data != nil {
+			return json.Unmarshal(data, &replaced)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if replaced.Owner == username {
+		size -= replaced.Size
+	}
+	return size, nil
+}
+
+// check tests size more bytes for username on volume against every
+// applicable quota; the caller must hold m.mu
+func (m *QuotaManager) check(username, volume string, size int64) (soft bool, err error) {
+	for _, quota := range m.applicable(username, volume) {
+		usage := m.usageOf(quota)
+		if quota.Hard > 0 && usage.Used+size > quota.Hard {
+			return false, &QuotaExceededError{Usage: usage}
+		}
+		if quota.Soft > 0 && usage.Used+size > quota.Soft {
+			soft = true
+		}
+	}
+	return soft, nil
+}
+
+// Charge records username as the owner of path and, for folders,
+// everything below it, replacing whatever was recorded there before
+func (m *QuotaManager) Charge(path, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(fileOwnersBucket)
+		if err := m.forget(b, path); err != nil {
+			return err
+		}
+
+		volume := volumeOf(path)
+		return filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+
+			data, err := json.Marshal(fileOwner{Owner: username, Size: info.Size()})
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(p), data); err != nil {
+				return err
+			}
+			m.add(volume, username, info.Size())
+			return nil
+		})
+	})
+}
+
+// Forget stops charging anyone for path and everything below it
+func (m *QuotaManager) Forget(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return m.forget(tx.Bucket(fileOwnersBucket), path)
+	})
+}
+
+// Move carries the owners recorded for src and below over to dst, which
+// replaces anything recorded at dst
+func (m *QuotaManager) Move(src, dst string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(fileOwnersBucket)
+		if err := m.forget(b, dst); err != nil {
+			return err
+		}
+
+		moved := make(map[string][]byte)
+		eachOwned(b, src, func(k, v []byte) {
+			moved[dst+strings.TrimPrefix(string(k), src)] = append([]byte(nil), v...)
+		})
+		if err := m.forget(b, src); err != nil {
+			return err
+		}
+
+		volume := volumeOf(dst)
+		for k, v := range moved {
+			var owner fileOwner
+			if err := json.Unmarshal(v, &owner); err != nil {
+				return err
+			}
+			if err := b.Put([]byte(k), v); err != nil {
+				return err
+			}
+			m.add(volume, owner.Owner, owner.Size)
+		}
+		return nil
+	})
+}
+
+// Set creates or replaces a quota
+func (m *QuotaManager) Set(quota Quota) error {
+	data, err := json.Marshal(quota)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := quotaKey(quota.Kind, quota.Name, quota.Volume)
+	err = m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(quotasBucket).Put([]byte(key), data)
+	})
+	if err != nil {
+		return err
+	}
+	m.quotas[key] = quota
+	return nil
+}
+
+// Delete removes a quota
+func (m *QuotaManager) Delete(kind, name, volume string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := quotaKey(kind, name, volume)
+	if _, exists := m.quotas[key]; !exists {
+		return ErrQuotaNotFound
+	}
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(quotasBucket).Delete([]byte(key))
+	})
+	if err != nil {
+		return err
+	}
+	delete(m.quotas, key)
+	return nil
+}
+
+// DeletePrincipal removes the quotas of a user or group on every volume
+func (m *QuotaManager) DeletePrincipal(kind, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var removed []string
+	for key, quota := range m.quotas {
+		if quota.Kind == kind && quota.Name == name {
+			removed = append(removed, key)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(quotasBucket)
+		for _, key := range removed {
+			if err := b.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range removed {
+		delete(m.quotas, key)
+	}
+	return nil
+}
+
+// Report returns every quota with its usage, or only those that apply to
+// username when it is set
+func (m *QuotaManager) Report(username string) []QuotaUsage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var quotas []Quota
+	if username == "" {
+		for _, quota := range m.quotas {
+			quotas = append(quotas, quota)
+		}
+	} else {
+		for _, root := range storage.Roots() {
+			quotas = append(quotas, m.applicable(username, root.Path)...)
+		}
+	}
+
+	report := make([]QuotaUsage, 0, len(quotas))
+	for _, quota := range quotas {
+		report = append(report, m.usageOf(quota))
+	}
+	sort.Slice(report, func(i, j int) bool {
+		return quotaKey(report[i].Kind, report[i].Name, report[i].Volume) < quotaKey(report[j].Kind, report[j].Name, report[j].Volume)
+	})
+	return report
+}
+
+// Usage returns the bytes owned per user and volume, or only username's
+// when it is set
+func (m *QuotaManager) Usage(username string) []VolumeUsage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	usage := []VolumeUsage{}
+	for volume, users := range m.usage {
+		for user, used := range users {
+			if username == "" || user == username {
+				usage = append(usage, VolumeUsage{Username: user, Volume: volume, Used: used})
+			}
+		}
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Volume != usage[j].Volume {
+			return usage[i].Volume < usage[j].Volume
+		}
+		return usage[i].Username < usage[j].Username
+	})
+	return usage
+}
+
+// applicable returns the quotas limiting username on volume: its own and
+// those of its groups. The caller must hold m.mu.
+func (m *QuotaManager) applicable(username, volume string) []Quota {
+	var quotas []Quota
+	if quota, exists := m.quotas[quotaKey(QuotaKindUser, username, volume)]; exists {
+		quotas = append(quotas, quota)
+	}
+	for _, group := range groupManager.GroupsFor(username) {
+		if quota, exists := m.quotas[quotaKey(QuotaKindGroup, group.Name, volume)]; exists {
+			quotas = append(quotas, quota)
+		}
+	}
+	return quotas
+}
+
+// usageOf totals what is charged or reserved against quota; the caller
+// must hold m.mu
+func (m *QuotaManager) usageOf(quota Quota) QuotaUsage {
+	usage := QuotaUsage{Quota: quota}
+	switch quota.Kind {
+	case QuotaKindUser:
+		usage.Used = m.used(quota.Volume, quota.Name)
+	case QuotaKindGroup:
+		if group, err := groupManager.Get(quota.Name); err == nil {
+			for _, member := range group.Members {
+				usage.Used += m.used(quota.Volume, member)
+			}
+		}
+	}
+	usage.SoftExceeded = quota.Soft > 0 && usage.Used > quota.Soft
+	usage.HardExceeded = quota.Hard > 0 && usage.Used > quota.Hard
+	return usage
+}
+
+// used returns the bytes charged to and reserved for username on volume;
+// the caller must hold m.mu
+func (m *QuotaManager) used(volume, username string) int64 {
+	used := m.usage[volume][username]
+	for _, reservation := range m.reserved {
+		if reservation.volume == volume && reservation.username == username {
+			used += reservation.size
+		}
+	}
+	return used
+}
+
+// forget deletes the records at and below path; the caller must hold m.mu
+func (m *QuotaManager) forget(b *bolt.Bucket, path string) error {
+	var keys [][]byte
+	var err error
+	volume := volumeOf(path)
+	eachOwned(b, path, func(k, v []byte) {
+		var owner fileOwner
+		if err = json.Unmarshal(v, &owner); err == nil {
+			m.add(volume, owner.Owner, -owner.Size)
+		}
+		keys = append(keys, append([]byte(nil), k...))
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add adjusts a user's total on a volume; the caller must hold m.mu or be
+// constructing m
+func (m *QuotaManager) add(volume, username string, size int64) {
+	users, exists := m.usage[volume]
+	if !exists {
+		users = make(map[string]int64)
+		m.usage[volume] = users
+	}
+	users[username] += size
+	if users[username] <= 0 {
+		delete(users, username)
+	}
+}
+
+// eachOwned calls fn for the record at path and every record below it
+func eachOwned(b *bolt.Bucket, path string, fn func(k, v []byte)) {
+	cursor := b.Cursor()
+	if k, v := cursor.Seek([]byte(path)); k != nil && string(k) == path {
+		fn(k, v)
+	}
+	prefix := []byte(path + string(filepath.Separator))
+	for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+		fn(k, v)
+	}
+}
+
+// volumeOf returns the volume a canonical path is on, including paths in
+// the reserved folders
+func volumeOf(path string) string {
+	for _, root := range storage.Roots() {
+		if isWithin(root.Path, path) {
+			return root.Path
+		}
+	}
+	return ""
+}
+
+func quotaKey(kind, name, volume string) string {
+	return kind + ":" + name + ":" + volume
+}
+
+// checkQuota verifies that username may write size bytes at path, replying
+// 507 when a hard limit is in the way. Passing a soft limit is reported in
+// the X-Quota-Warning header. It reports whether the write may go ahead.
+func checkQuota(c *gin.Context, username, path string, size int64) bool {
+	soft, err := quotaManager.Check(username, path, size)
+	return quotaAllows(c, soft, err)
+}
+
+// reserveQuota is checkQuota for writes that take a while. The space stays
+// reserved under the returned key until it is released.
+func reserveQuota(c *gin.Context, username, path string, size int64) (key string, ok bool) {
+	key, err := generateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot check storage quota"})
+		c.Abort()
+		return "", false
+	}
+	soft, err := quotaManager.Reserve(key, username, path, size)
+	return key, quotaAllows(c, soft, err)
+}
+
+// quotaAllows replies to the outcome of a quota check as checkQuota does
+func quotaAllows(c *gin.Context, soft bool, err error) bool {
+	var exceeded *QuotaExceededError
+	if errors.As(err, &exceeded) {
+		writeQuotaExceeded(c, exceeded)
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot check storage quota"})
+		c.Abort()
+		return false
+	}
+
+	if soft {
+		c.Header("X-Quota-Warning", "Soft quota exceeded")
+	}
+	return true
+}
+
+func writeQuotaExceeded(c *gin.Context, exceeded *QuotaExceededError) {
+	c.JSON(http.StatusInsufficientStorage, gin.H{
+		"error": "Storage quota exceeded",
+		"quota": exceeded.Usage,
+	})
+	c.Abort()
+}
+
+// chargeFile records a completed write, logging rather than failing since
+// the data is already in place
+func chargeFile(path, username string) {
+	if err := quotaManager.Charge(path, username); err != nil {
+		log.Printf("Failed to charge %s to %s: %v", path, username, err)
+	}
+}
+
+// GetQuotas reports the caller's usage and the quotas that apply to them.
+// User admins get every quota and everyone's usage with ?all=true.
+func GetQuotas(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	username := user.Username
+	if hasPermission(c, PermUsersAdmin) && c.Query("all") == "true" {
+		username = ""
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"quotas": quotaManager.Report(username),
+		"usage":  quotaManager.Usage(username),
+	})
+}
+
+// SetQuota creates or replaces the quota for a user or group on a volume
+func SetQuota(c *gin.Context) {
+	var quota Quota
+	if err := c.ShouldBindJSON(&quota); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if quota.Soft > 0 && quota.Hard > 0 && quota.Soft > quota.Hard {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Soft limit must not exceed the hard limit"})
+		return
+	}
+
+	volume, ok := quotaVolume(c, quota.Volume)
+	if !ok {
+		return
+	}
+	quota.Volume = volume
+
+	switch quota.Kind {
+	case QuotaKindUser:
+		if _, err := userStore.GetUser(quota.Name); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown user: " + quota.Name})
+			return
+		}
+	case QuotaKindGroup:
+		if _, err := groupManager.Get(quota.Name); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown group: " + quota.Name})
+			return
+		}
+	}
+
+	if err := quotaManager.Set(quota); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save quota"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"quota": quota})
+}
+
+// DeleteQuota removes the quota given by ?kind=, ?name= and ?volume=
+func DeleteQuota(c *gin.Context) {
+	volume, ok := quotaVolume(c, c.Query("volume"))
+	if !ok {
+		return
+	}
+
+	if err := quotaManager.Delete(c.Query("kind"), c.Query("name"), volume); err != nil {
+		if errors.Is(err, ErrQuotaNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Quota not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete quota"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Quota deleted successfully"})
+}
+
+// quotaVolume maps a volume given by name or path to its canonical path
+func quotaVolume(c *gin.Context, volume string) (string, bool) {
+	for _, root := range storage.Roots() {
+		if volume == root.Name || volume == root.Path {
+			return root.Path, true
+		}
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown volume: " + volume})
+	return "", false
+}
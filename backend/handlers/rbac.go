@@ -0,0 +1,415 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Permissions understood by RequirePermission
+const (
+	PermUsersAdmin    = "users:admin"
+	PermSessionsAdmin = "sessions:admin"
+	PermRolesAdmin    = "roles:admin"
+	PermSystemRead    = "system:read"
+	PermFilesRead     = "files:read"
+	PermFilesWrite    = "files:write"
+	PermSambaRead     = "samba:read"
+	PermSambaAdmin    = "samba:admin"
+	PermNetworkRead   = "network:read"
+)
+
+// AllPermissions describes every known permission
+var AllPermissions = map[string]string{
+	PermUsersAdmin:    "Create, list and delete user accounts",
+	PermSessionsAdmin: "List and revoke sessions of any user",
+	PermRolesAdmin:    "Define custom roles",
+	PermSystemRead:    "View system monitoring data",
+	PermFilesRead:     "Browse and download files",
+	PermFilesWrite:    "Upload, create and delete files",
+	PermSambaRead:     "View Samba shares and service status",
+	PermSambaAdmin:    "Manage Samba shares and the Samba service",
+	PermNetworkRead:   "View network configuration",
+}
+
+var (
+	ErrRoleNotFound = errors.New("role not found")
+	ErrRoleExists   = errors.New("role already exists")
+	ErrRoleBuiltIn  = errors.New("built-in roles cannot be modified")
+)
+
+var rolesBucket = []byte("roles")
+
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{1,31}$`)
+
+type Role struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+	BuiltIn     bool     `json:"builtIn"`
+}
+
+type RoleRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions" binding:"required"`
+}
+
+// builtInRoles are always available and cannot be edited or deleted
+func builtInRoles() []Role {
+	all := make([]string, 0, len(AllPermissions))
+	for perm := range AllPermissions {
+		all = append(all, perm)
+	}
+	sort.Strings(all)
+
+	return []Role{
+		{
+			Name:        "admin",
+			Description: "Full access to every feature",
+			Permissions: all,
+			BuiltIn:     true,
+		},
+		{
+			Name:        "user",
+			Description: "Regular user with file access",
+			Permissions: []string{PermFilesRead, PermFilesWrite, PermNetworkRead, PermSambaRead, PermSystemRead},
+			BuiltIn:     true,
+		},
+		{
+			Name:        "readonly",
+			Description: "Can browse and download files only",
+			Permissions: []string{PermFilesRead, PermSystemRead},
+			BuiltIn:     true,
+		},
+	}
+}
+
+// RoleManager resolves role names to permissions, caching custom roles
+// stored in the database
+type RoleManager struct {
+	mu    sync.RWMutex
+	db    *bolt.DB
+	roles map[string]Role
+}
+
+var roleManager *RoleManager
+
+// SetRoleManager configures the manager used for authorization checks
+func SetRoleManager(manager *RoleManager) {
+	roleManager = manager
+}
+
+// NewRoleManager loads custom roles from db alongside the built-in ones
+func NewRoleManager(db *bolt.DB) (*RoleManager, error) {
+	m := &RoleManager{
+		db:    db,
+		roles: make(map[string]Role),
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(rolesBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(_, v []byte) error {
+			var role Role
+			if err := json.Unmarshal(v, &role); err != nil {
+				return err
+			}
+			m.roles[role.Name] = role
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, role := range builtInRoles() {
+		m.roles[role.Name] = role
+	}
+	return m, nil
+}
+
+// Get returns the named role
+func (m *RoleManager) Get(name string) (Role, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	role, exists := m.roles[name]
+	if !exists {
+		return Role{}, ErrRoleNotFound
+	}
+	return role, nil
+}
+
+// List returns all roles sorted by name
+func (m *RoleManager) List() []Role {
+	m.mu.RLock()
+	list := make([]Role, 0, len(m.roles))
+	for _, role := range m.roles {
+		list = append(list, role)
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Save creates or replaces a custom role
+func (m *RoleManager) Save(role Role, create bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, exists := m.roles[role.Name]
+	if exists && existing.BuiltIn {
+		return ErrRoleBuiltIn
+	}
+	if create && exists {
+		return ErrRoleExists
+	}
+	if !create && !exists {
+		return ErrRoleNotFound
+	}
+
+	role.BuiltIn = false
+	data, err := json.Marshal(role)
+	if err != nil {
+		return err
+	}
+	err = m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(rolesBucket).Put([]byte(role.Name), data)
+	})
+	if err != nil {
+		return err
+	}
+
+	m.roles[role.Name] = role
+	return nil
+}
+
+// Delete removes a custom role
+func (m *RoleManager) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	role, exists := m.roles[name]
+	if !exists {
+		return ErrRoleNotFound
+	}
+	if role.BuiltIn {
+		return ErrRoleBuiltIn
+	}
+
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(rolesBucket).Delete([]byte(name))
+	})
+	if err != nil {
+		return err
+	}
+
+	delete(m.roles, name)
+	return nil
+}
+
+// Permissions returns the permission set granted to user by their own role
+// and the roles of every group they belong to
+func (m *RoleManager) Permissions(user *User) map[string]bool {
+	roles := []string{user.Role}
+	if groupManager != nil {
+		for _, group := range groupManager.GroupsFor(user.Username) {
+			roles = append(roles, group.Roles...)
+		}
+	}
+
+	perms := make(map[string]bool)
+	for _, name := range roles {
+		if role, err := m.Get(name); err == nil {
+			for _, perm := range role.Permissions {
+				perms[perm] = true
+			}
+		}
+	}
+	return perms
+}
+
+// hasPermission reports whether the authenticated caller holds perm. Requests
+// made with a scoped API token are limited to the token's scopes.
+func hasPermission(c *gin.Context, perm string) bool {
+	value, exists := c.Get("user")
+	if !exists {
+		return false
+	}
+	if !roleManager.Permissions(value.(*User))[perm] {
+		return false
+	}
+
+	if value, exists := c.Get("apiToken"); exists {
+		token := value.(*APIToken)
+		if len(token.Scopes) > 0 {
+			for _, scope := range token.Scopes {
+				if scope == perm {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// RequirePermission aborts with 403 unless the caller holds every permission
+func RequirePermission(perms ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, perm := range perms {
+			if !hasPermission(c, perm) {
+				c.JSON(http.StatusForbidden, gin.H{
+					"error":      "Permission denied",
+					"permission": perm,
+				})
+				c.Abort()
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// RejectScopedTokens aborts with 403 when the caller authenticated with a
+// scoped API token. It guards account credentials, which a token limited to
+// some permissions must not be able to replace with broader ones.
+func RejectScopedTokens() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if value, exists := c.Get("apiToken"); exists && len(value.(*APIToken).Scopes) > 0 {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Not available to scoped API tokens"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// GetPermissions lists every known permission
+func GetPermissions(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"permissions": AllPermissions})
+}
+
+// GetRoles lists built-in and custom roles
+func GetRoles(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"roles": roleManager.List()})
+}
+
+// CreateRole defines a new custom role
+func CreateRole(c *gin.Context) {
+	var req RoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !roleNamePattern.MatchString(req.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role name"})
+		return
+	}
+
+	saveRole(c, req, true)
+}
+
+// UpdateRole replaces the description and permissions of a custom role
+func UpdateRole(c *gin.Context) {
+	var req RoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	req.Name = c.Param("name")
+	saveRole(c, req, false)
+}
+
+// DeleteRole removes a custom role that is no longer assigned to anyone
+func DeleteRole(c *gin.Context) {
+	name := c.Param("name")
+
+	role, err := roleManager.Get(name)
+	if err != nil {
+		writeRoleError(c, err)
+		return
+	}
+	if role.BuiltIn {
+		writeRoleError(c, ErrRoleBuiltIn)
+		return
+	}
+
+	userList, err := userStore.ListUsers()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load users"})
+		return
+	}
+	for _, u := range userList {
+		if u.Role == name {
+			c.JSON(http.StatusConflict, gin.H{"error": "Role is assigned to users"})
+			return
+		}
+	}
+	for _, group := range groupManager.List() {
+		if containsString(group.Roles, name) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Role is assigned to groups"})
+			return
+		}
+	}
+
+	if err := roleManager.Delete(name); err != nil {
+		writeRoleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Role deleted successfully"})
+}
+
+func saveRole(c *gin.Context, req RoleRequest, create bool) {
+	for _, perm := range req.Permissions {
+		if _, known := AllPermissions[perm]; !known {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown permission: " + perm})
+			return
+		}
+	}
+
+	perms := append([]string(nil), req.Permissions...)
+	sort.Strings(perms)
+	role := Role{
+		Name:        req.Name,
+		Description: req.Description,
+		Permissions: perms,
+	}
+
+	if err := roleManager.Save(role, create); err != nil {
+		writeRoleError(c, err)
+		return
+	}
+
+	status := http.StatusOK
+	if create {
+		status = http.StatusCreated
+	}
+	c.JSON(status, gin.H{"role": role})
+}
+
+func writeRoleError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrRoleNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+	case errors.Is(err, ErrRoleExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "Role already exists"})
+	case errors.Is(err, ErrRoleBuiltIn):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Built-in roles cannot be modified"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save role"})
+	}
+}
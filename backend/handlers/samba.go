@@ -18,6 +18,7 @@ type SambaShare struct {
 	ReadOnly    bool   `json:"readOnly"`
 	GuestAccess bool   `json:"guestAccess"`
 	Users       []string `json:"users"`
+	Groups      []string `json:"groups"`
 }
 
 type SambaConfig struct {
@@ -35,6 +36,7 @@ func GetSambaShares(c *gin.Context) {
 			ReadOnly:    false,
 			GuestAccess: true,
 			Users:       []string{"guest"},
+			Groups:      []string{},
 		},
 		{
 			Name:        "media",
@@ -43,6 +45,7 @@ func GetSambaShares(c *gin.Context) {
 			ReadOnly:    true,
 			GuestAccess: false,
 			Users:       []string{"admin"},
+			Groups:      []string{},
 		},
 	}
 
@@ -80,6 +83,12 @@ func CreateSambaShare(c *gin.Context) {
 		return
 	}
 
+	// Referenced groups must exist
+	if err := validateGroupNames(share.Groups); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown group"})
+		return
+	}
+
 	// Create directory if it doesn't exist
 	if err := os.MkdirAll(cleanPath, 0755); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot create share directory"})
@@ -198,8 +207,27 @@ func generateSambaConfig(share SambaShare) string {
 		boolToYesNo(share.GuestAccess),
 	)
 
-	if len(share.Users) > 0 && !share.GuestAccess {
-		config += fmt.Sprintf("   valid users = %s\n", strings.Join(share.Users, " "))
+	// Samba's @group syntax names Unix groups, which app groups are not,
+	// so their members are listed one by one
+	validUsers := append([]string{}, share.Users...)
+	for _, name := range share.Groups {
+		group, err := groupManager.Get(name)
+		if err != nil {
+			continue
+		}
+		for _, member := range group.Members {
+			if !containsString(validUsers, member) {
+				validUsers = append(validUsers, member)
+			}
+		}
+	}
+	if (len(share.Users) > 0 || len(share.Groups) > 0) && !share.GuestAccess {
+		if len(validUsers) == 0 {
+			// An empty list would let every user in
+			config += "   available = no\n"
+		} else {
+			config += fmt.Sprintf("   valid users = %s\n", strings.Join(validUsers, " "))
+		}
 	}
 
 	return config
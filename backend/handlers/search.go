@@ -0,0 +1,690 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gin-gonic/gin"
+	"github.com/ledongthuc/pdf"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// maxExtractSize skips content extraction for larger files
+	maxExtractSize = 20 << 20
+	// maxIndexedContent caps the text kept per file
+	maxIndexedContent = 64 << 10
+	// indexFlushInterval batches filesystem events before reindexing
+	indexFlushInterval = time.Second
+	// defaultSearchLimit and maxSearchLimit bound the number of results
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+)
+
+var searchIndexBucket = []byte("search_index")
+
+// searchIndexVersion is bumped whenever the way entries are built changes,
+// discarding a saved index so that every file is read again. The key sorts
+// before any path.
+var (
+	searchIndexVersionKey = []byte("\x00version")
+	searchIndexVersion    = []byte("2")
+)
+
+// textExtensions are indexed as plain text regardless of MIME type
+var textExtensions = map[string]bool{
+	".txt": true, ".md": true, ".csv": true, ".tsv": true, ".log": true,
+	".json": true, ".xml": true, ".yaml": true, ".yml": true, ".toml": true,
+	".ini": true, ".conf": true, ".html": true, ".htm": true, ".css": true,
+	".js": true, ".ts": true, ".go": true, ".py": true, ".rb": true,
+	".java": true, ".c": true, ".h": true, ".cpp": true, ".rs": true,
+	".sh": true, ".sql": true, ".tex": true, ".rtf": true,
+}
+
+// indexEntry is what the search index knows about a file or folder.
+// Content holds lowercased text for text and PDF files.
+type indexEntry struct {
+	Path     string    `json:"path"`
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	IsDir    bool      `json:"isDir"`
+	ModTime  time.Time `json:"modTime"`
+	MimeType string    `json:"mimeType"`
+	Content  string    `json:"content,omitempty"`
+}
+
+func (entry *indexEntry) category() string {
+	if entry.IsDir {
+		return CategoryFolder
+	}
+	return fileCategory(entry.Name, entry.MimeType)
+}
+
+type SearchResult struct {
+	FileInfo
+	// Matches lists where the query was found: name, path or content
+	Matches []string `json:"matches"`
+	Snippet string   `json:"snippet,omitempty"`
+
+	score int
+}
+
+// SearchIndex keeps file metadata and extracted text for every volume in
+// memory, mirrored to bolt so restarts only re-read files that changed.
+// Changes are picked up through filesystem notifications.
+type SearchIndex struct {
+	mu      sync.RWMutex
+	db      *bolt.DB
+	entries map[string]*indexEntry
+
+	watcher   *fsnotify.Watcher
+	pendingMu sync.Mutex
+	pending   map[string]bool
+}
+
+var searchIndex *SearchIndex
+
+// SetSearchIndex configures the index used by SearchFiles
+func SetSearchIndex(index *SearchIndex) {
+	searchIndex = index
+}
+
+// NewSearchIndex loads the previously saved index from db
+func NewSearchIndex(db *bolt.DB) (*SearchIndex, error) {
+	idx := &SearchIndex{
+		db:      db,
+		entries: make(map[string]*indexEntry),
+		pending: make(map[string]bool),
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(searchIndexBucket)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(b.Get(searchIndexVersionKey), searchIndexVersion) {
+			if err := tx.DeleteBucket(searchIndexBucket); err != nil {
+				return err
+			}
+			if b, err = tx.CreateBucket(searchIndexBucket); err != nil {
+				return err
+			}
+			return b.Put(searchIndexVersionKey, searchIndexVersion)
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			if bytes.Equal(k, searchIndexVersionKey) {
+				return nil
+			}
+			var entry indexEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			idx.entries[entry.Path] = &entry
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Start watches the storage volumes and brings the index up to date in the
+// background. Stop releases the watches.
+func (idx *SearchIndex) Start() (stop func(), err error) {
+	idx.watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go idx.watch(done)
+	go func() {
+		started := time.Now()
+		idx.reconcile()
+		log.Printf("Search index ready with %d entries in %s", idx.Len(), time.Since(started).Round(time.Millisecond))
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			idx.watcher.Close()
+		})
+	}, nil
+}
+
+// Len returns the number of indexed files and folders
+func (idx *SearchIndex) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.entries)
+}
+
+// reconcile walks every volume, indexing new and changed files and
+// dropping entries for files that no longer exist
+func (idx *SearchIndex) reconcile() {
+	seen := make(map[string]bool)
+	for _, root := range storage.Roots() {
+		idx.indexTree(root.Path, seen)
+	}
+
+	idx.mu.RLock()
+	var stale []string
+	for path := range idx.entries {
+		if !seen[path] {
+			stale = append(stale, path)
+		}
+	}
+	idx.mu.RUnlock()
+
+	idx.apply(nil, stale)
+}
+
+// indexTree indexes root and everything below it, watching each folder.
+// Paths visited are added to seen when it is not nil.
+func (idx *SearchIndex) indexTree(root string, seen map[string]bool) {
+	var updates []*indexEntry
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if storage.IsReserved(p) || isTemporaryName(d.Name()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		// Links may lead outside the volumes; they are not indexed
+		if d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+
+		if d.IsDir() {
+			if err := idx.watcher.Add(p); err != nil {
+				log.Printf("Cannot watch %s: %v", p, err)
+			}
+		}
+		if seen != nil {
+			seen[p] = true
+		}
+
+		if storage.IsRoot(p) {
+			return nil
+		}
+		if entry := idx.refresh(p); entry != nil {
+			updates = append(updates, entry)
+			if len(updates) >= 500 {
+				idx.apply(updates, nil)
+				updates = nil
+			}
+		}
+		return nil
+	})
+	idx.apply(updates, nil)
+}
+
+// refresh returns a new entry for p if it is not indexed or has changed
+func (idx *SearchIndex) refresh(p string) *indexEntry {
+	info, err := os.Lstat(p)
+	if err != nil {
+		return nil
+	}
+
+	idx.mu.RLock()
+	existing := idx.entries[p]
+	idx.mu.RUnlock()
+	if existing != nil && existing.Size == info.Size() && existing.ModTime.Equal(info.ModTime()) && existing.IsDir == info.IsDir() {
+		return nil
+	}
+
+	entry := &indexEntry{
+		Path:    p,
+		Name:    info.Name(),
+		Size:    info.Size(),
+		IsDir:   info.IsDir(),
+		ModTime: info.ModTime(),
+	}
+	if !info.IsDir() {
+		entry.MimeType = detectMimeType(p)
+		if info.Size() <= maxExtractSize {
+			entry.Content = extractText(p, entry.MimeType)
+		}
+	}
+	return entry
+}
+
+// apply stores updated entries and removes the given paths along with
+// anything indexed below them
+func (idx *SearchIndex) apply(updates []*indexEntry, removed []string) {
+	if len(updates) == 0 && len(removed) == 0 {
+		return
+	}
+
+	idx.mu.Lock()
+	var deleted []string
+	for _, path := range removed {
+		prefix := path + string(filepath.Separator)
+		for p := range idx.entries {
+			if p == path || strings.HasPrefix(p, prefix) {
+				delete(idx.entries, p)
+				deleted = append(deleted, p)
+			}
+		}
+	}
+	for _, entry := range updates {
+		idx.entries[entry.Path] = entry
+	}
+	idx.mu.Unlock()
+
+	err := idx.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(searchIndexBucket)
+		for _, p := range deleted {
+			if err := b.Delete([]byte(p)); err != nil {
+				return err
+			}
+		}
+		for _, entry := range updates {
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(entry.Path), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to save search index: %v", err)
+	}
+}
+
+// watch collects filesystem events and reindexes the affected paths in
+// batches, so that a burst of writes to one file is only read once
+func (idx *SearchIndex) watch(done chan struct{}) {
+	ticker := time.NewTicker(indexFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-idx.watcher.Events:
+			if !ok {
+				return
+			}
+			idx.pendingMu.Lock()
+			idx.pending[event.Name] = true
+			idx.pendingMu.Unlock()
+		case err, ok := <-idx.watcher.Errors:
+			if !ok {
+				return
+			}
+			// Usually an overflowed event queue; a full pass catches up
+			log.Printf("Search index watcher error: %v", err)
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				go idx.reconcile()
+			}
+		case <-ticker.C:
+			idx.flush()
+		case <-done:
+			return
+		}
+	}
+}
+
+func (idx *SearchIndex) flush() {
+	idx.pendingMu.Lock()
+	pending := idx.pending
+	idx.pending = make(map[string]bool)
+	idx.pendingMu.Unlock()
+
+	var updates []*indexEntry
+	var removed []string
+	for p := range pending {
+		if storage.IsReserved(p) || isTemporaryName(filepath.Base(p)) {
+			continue
+		}
+		info, err := os.Lstat(p)
+		switch {
+		case err != nil:
+			// Folders moved away keep their watch otherwise
+			idx.watcher.Remove(p)
+			removed = append(removed, p)
+		case info.IsDir():
+			// New or moved-in folders need their contents indexed and
+			// watched as well
+			idx.indexTree(p, nil)
+		case info.Mode().IsRegular():
+			if entry := idx.refresh(p); entry != nil {
+				updates = append(updates, entry)
+			}
+		}
+	}
+	idx.apply(updates, removed)
+}
+
+// Search returns entries matching every term of query and the filters,
+// best matches first, along with the total number of matches
+func (idx *SearchIndex) Search(query string, filter SearchFilter, limit int) ([]SearchResult, int) {
+	terms := strings.Fields(strings.ToLower(query))
+
+	idx.mu.RLock()
+	var results []SearchResult
+	for _, entry := range idx.entries {
+		if !filter.matches(entry) {
+			continue
+		}
+		if result, ok := matchEntry(entry, terms); ok {
+			results = append(results, result)
+		}
+	}
+	idx.mu.RUnlock()
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].ModTime.After(results[j].ModTime)
+	})
+
+	total := len(results)
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, total
+}
+
+// matchEntry checks that every term occurs in the entry's name, path or
+// content. Name matches rank above path matches, which rank above content.
+func matchEntry(entry *indexEntry, terms []string) (SearchResult, bool) {
+	result := SearchResult{
+		FileInfo: FileInfo{
+			Name:     entry.Name,
+			Path:     entry.Path,
+			Size:     entry.Size,
+			IsDir:    entry.IsDir,
+			ModTime:  entry.ModTime,
+			MimeType: entry.MimeType,
+			Category: entry.category(),
+		},
+		Matches: []string{},
+	}
+
+	name := strings.ToLower(entry.Name)
+	path := strings.ToLower(entry.Path)
+	var inName, inPath, inContent bool
+	for _, term := range terms {
+		switch {
+		case strings.Contains(name, term):
+			inName = true
+			result.score += 100
+			if name == term || strings.HasPrefix(name, term) {
+				result.score += 50
+			}
+		case strings.Contains(path, term):
+			inPath = true
+			result.score += 10
+		case strings.Contains(entry.Content, term):
+			inContent = true
+			result.score++
+			if result.Snippet == "" {
+				result.Snippet = snippet(entry.Content, term)
+			}
+		default:
+			return result, false
+		}
+	}
+
+	if inName {
+		result.Matches = append(result.Matches, "name")
+	}
+	if inPath {
+		result.Matches = append(result.Matches, "path")
+	}
+	if inContent {
+		result.Matches = append(result.Matches, "content")
+	}
+	return result, true
+}
+
+// snippet returns the text around the first occurrence of term
+func snippet(content, term string) string {
+	const context = 60
+
+	i := strings.Index(content, term)
+	start, end := max(i-context, 0), min(i+len(term)+context, len(content))
+	// Do not cut multi-byte characters in half
+	for start > 0 && !utf8.RuneStart(content[start]) {
+		start--
+	}
+	for end < len(content) && !utf8.RuneStart(content[end]) {
+		end++
+	}
+
+	s := strings.Join(strings.Fields(content[start:end]), " ")
+	if start > 0 {
+		s = "…" + s
+	}
+	if end < len(content) {
+		s += "…"
+	}
+	return s
+}
+
+// extractText returns the lowercased text of text and PDF files, or ""
+func extractText(p, mimeType string) string {
+	var text string
+	switch {
+	case mimeType == "application/pdf":
+		text = extractPDFText(p)
+	case strings.HasPrefix(mimeType, "text/") || textExtensions[strings.ToLower(filepath.Ext(p))]:
+		f, err := os.Open(p)
+		if err != nil {
+			return ""
+		}
+		defer f.Close()
+
+		data, err := io.ReadAll(io.LimitReader(f, maxIndexedContent))
+		if err != nil || bytes.IndexByte(data, 0) >= 0 {
+			// NUL bytes mean this is not really text
+			return ""
+		}
+		text = string(data)
+	default:
+		return ""
+	}
+
+	if len(text) > maxIndexedContent {
+		text = text[:maxIndexedContent]
+	}
+	return strings.ToLower(strings.ToValidUTF8(text, ""))
+}
+
+func extractPDFText(p string) (text string) {
+	// The PDF parser panics on some malformed files
+	defer func() {
+		if recover() != nil {
+			text = ""
+		}
+	}()
+
+	f, r, err := pdf.Open(p)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	plain, err := r.GetPlainText()
+	if err != nil {
+		return ""
+	}
+	data, _ := io.ReadAll(io.LimitReader(plain, maxIndexedContent))
+	return string(data)
+}
+
+// isTemporaryName matches the hidden names used while uploads, copies and
+// overwrites are in progress
+func isTemporaryName(name string) bool {
+	return strings.HasPrefix(name, ".") && (strings.HasSuffix(name, ".part") || strings.HasSuffix(name, ".old"))
+}
+
+// SearchFilter narrows search results by type, size, date and location
+type SearchFilter struct {
+	// Types are categories such as "document" or "folder", or MIME type
+	// prefixes such as "image/" or "application/pdf"
+	Types          []string
+	MinSize        int64
+	MaxSize        int64
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+	// Under restricts results to a folder
+	Under string
+	// Visible, when set, hides entries for which it returns false
+	Visible func(path string) bool
+}
+
+func (f SearchFilter) matches(entry *indexEntry) bool {
+	if len(f.Types) > 0 {
+		matched := false
+		category := entry.category()
+		for _, t := range f.Types {
+			if t == category || !entry.IsDir && strings.Contains(t, "/") && strings.HasPrefix(entry.MimeType, t) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	// Folder sizes say nothing about their contents
+	if (f.MinSize > 0 || f.MaxSize > 0) && entry.IsDir {
+		return false
+	}
+	if f.MinSize > 0 && entry.Size < f.MinSize {
+		return false
+	}
+	if f.MaxSize > 0 && entry.Size > f.MaxSize {
+		return false
+	}
+	if !f.ModifiedAfter.IsZero() && entry.ModTime.Before(f.ModifiedAfter) {
+		return false
+	}
+	if !f.ModifiedBefore.IsZero() && entry.ModTime.After(f.ModifiedBefore) {
+		return false
+	}
+	if f.Under != "" && (entry.Path == f.Under || !isWithin(f.Under, entry.Path)) {
+		return false
+	}
+	if f.Visible != nil && !f.Visible(entry.Path) {
+		return false
+	}
+	return true
+}
+
+// parseSearchDate accepts RFC 3339 timestamps or plain dates. A plain date
+// used as an upper bound covers the whole day.
+func parseSearchDate(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
+
+// SearchFiles finds files by name, path and content. Supported filters:
+// type (comma-separated), minSize, maxSize, modifiedAfter, modifiedBefore,
+// path and limit. Only files the caller may read are found.
+func SearchFiles(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+	query := strings.TrimSpace(c.Query("q"))
+
+	filter := SearchFilter{
+		Visible: func(path string) bool { return aclManager.Allowed(user, path, ACLRead) },
+	}
+	if types := c.Query("type"); types != "" {
+		for _, t := range strings.Split(types, ",") {
+			filter.Types = append(filter.Types, strings.ToLower(strings.TrimSpace(t)))
+		}
+	}
+
+	var err error
+	if v := c.Query("minSize"); v != "" {
+		if filter.MinSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid minSize"})
+			return
+		}
+	}
+	if v := c.Query("maxSize"); v != "" {
+		if filter.MaxSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid maxSize"})
+			return
+		}
+	}
+	if v := c.Query("modifiedAfter"); v != "" {
+		if filter.ModifiedAfter, err = parseSearchDate(v, false); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid modifiedAfter"})
+			return
+		}
+	}
+	if v := c.Query("modifiedBefore"); v != "" {
+		if filter.ModifiedBefore, err = parseSearchDate(v, true); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid modifiedBefore"})
+			return
+		}
+	}
+	if v := c.Query("path"); v != "" {
+		under, ok := resolveRequestPath(c, v)
+		if !ok {
+			return
+		}
+		filter.Under = under
+	}
+
+	if query == "" && len(filter.Types) == 0 && filter.MinSize == 0 && filter.MaxSize == 0 &&
+		filter.ModifiedAfter.IsZero() && filter.ModifiedBefore.IsZero() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Search query or filter required"})
+		return
+	}
+
+	limit := defaultSearchLimit
+	if v := c.Query("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = min(limit, maxSearchLimit)
+	}
+
+	results, total := searchIndex.Search(query, filter, limit)
+	if results == nil {
+		results = []SearchResult{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"query":   query,
+		"results": results,
+		"total":   total,
+	})
+}
@@ -0,0 +1,381 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrSessionExpired  = errors.New("session expired")
+)
+
+var sessionsBucket = []byte("sessions")
+
+// sessionTouchInterval limits how often sliding expiry is written to disk
+const sessionTouchInterval = time.Minute
+
+type Session struct {
+	ID        string    `json:"id"`
+	Token     string    `json:"-"`
+	UserID    int       `json:"userId"`
+	Username  string    `json:"username"`
+	ClientIP  string    `json:"clientIp"`
+	UserAgent string    `json:"userAgent"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Expires   time.Time `json:"expires"`
+}
+
+// SessionManager tracks login sessions, keyed by the SHA-256 of their token
+// so that plaintext tokens never touch the disk
+type SessionManager struct {
+	mu          sync.RWMutex
+	db          *bolt.DB
+	sessions    map[string]*Session
+	persisted   map[string]time.Time
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+}
+
+var sessionManager *SessionManager
+
+// SetSessionManager configures the manager used for login sessions
+func SetSessionManager(manager *SessionManager) {
+	sessionManager = manager
+}
+
+// NewSessionManager loads unexpired sessions from db. Sessions expire after
+// idleTimeout without use and never live longer than maxLifetime.
+func NewSessionManager(db *bolt.DB, idleTimeout, maxLifetime time.Duration) (*SessionManager, error) {
+	m := &SessionManager{
+		db:          db,
+		sessions:    make(map[string]*Session),
+		persisted:   make(map[string]time.Time),
+		idleTimeout: idleTimeout,
+		maxLifetime: maxLifetime,
+	}
+
+	now := time.Now()
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(sessionsBucket)
+		if err != nil {
+			return err
+		}
+
+		var expired [][]byte
+		err = b.ForEach(func(k, v []byte) error {
+			var session Session
+			if err := json.Unmarshal(v, &session); err != nil {
+				return err
+			}
+			if now.After(session.Expires) {
+				expired = append(expired, k)
+				return nil
+			}
+			m.sessions[string(k)] = &session
+			m.persisted[string(k)] = session.LastSeen
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Create starts a new session for user and returns its bearer token
+func (m *SessionManager) Create(user *User, clientIP, userAgent string) (string, *Session, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := generateToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	session := &Session{
+		ID:        id[:16],
+		Token:     token,
+		UserID:    user.ID,
+		Username:  user.Username,
+		ClientIP:  clientIP,
+		UserAgent: userAgent,
+		Created:   now,
+		LastSeen:  now,
+		Expires:   m.expiry(now, now),
+	}
+
+	key := hashToken(token)
+	if err := m.persist(key, session); err != nil {
+		return "", nil, err
+	}
+
+	m.mu.Lock()
+	m.sessions[key] = session
+	m.persisted[key] = now
+	m.mu.Unlock()
+
+	return token, session, nil
+}
+
+// Validate looks up the session for token and slides its expiry forward
+func (m *SessionManager) Validate(token string) (*Session, error) {
+	key := hashToken(token)
+	now := time.Now()
+
+	m.mu.Lock()
+	session, exists := m.sessions[key]
+	if !exists {
+		m.mu.Unlock()
+		return nil, ErrSessionNotFound
+	}
+	if now.After(session.Expires) {
+		delete(m.sessions, key)
+		delete(m.persisted, key)
+		m.mu.Unlock()
+		m.remove(key)
+		return nil, ErrSessionExpired
+	}
+
+	session.LastSeen = now
+	session.Expires = m.expiry(session.Created, now)
+	snapshot := *session
+	needsWrite := now.Sub(m.persisted[key]) >= sessionTouchInterval
+	if needsWrite {
+		m.persisted[key] = now
+	}
+	m.mu.Unlock()
+
+	if needsWrite {
+		if err := m.persist(key, &snapshot); err != nil {
+			log.Printf("Failed to persist session %s: %v", snapshot.ID, err)
+		}
+	}
+	return &snapshot, nil
+}
+
+// List returns active sessions, optionally restricted to one user (userID > 0)
+func (m *SessionManager) List(userID int) []Session {
+	now := time.Now()
+
+	m.mu.RLock()
+	var list []Session
+	for _, session := range m.sessions {
+		if now.After(session.Expires) {
+			continue
+		}
+		if userID > 0 && session.UserID != userID {
+			continue
+		}
+		list = append(list, *session)
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// Get returns the session with the given ID
+func (m *SessionManager) Get(id string) (*Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, session := range m.sessions {
+		if session.ID == id {
+			snapshot := *session
+			return &snapshot, nil
+		}
+	}
+	return nil, ErrSessionNotFound
+}
+
+// Revoke ends the session with the given ID
+func (m *SessionManager) Revoke(id string) error {
+	removed := m.removeWhere(func(s *Session) bool { return s.ID == id })
+	if removed == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeToken ends the session identified by its bearer token
+func (m *SessionManager) RevokeToken(token string) {
+	key := hashToken(token)
+
+	m.mu.Lock()
+	delete(m.sessions, key)
+	delete(m.persisted, key)
+	m.mu.Unlock()
+
+	m.remove(key)
+}
+
+// RevokeUser ends every session belonging to userID and returns how many
+func (m *SessionManager) RevokeUser(userID int) int {
+	return m.RevokeUserExcept(userID, "")
+}
+
+// RevokeUserExcept ends all of userID's sessions other than keepID
+func (m *SessionManager) RevokeUserExcept(userID int, keepID string) int {
+	return m.removeWhere(func(s *Session) bool { return s.UserID == userID && s.ID != keepID })
+}
+
+// Reap deletes all expired sessions and returns how many were removed
+func (m *SessionManager) Reap() int {
+	now := time.Now()
+	return m.removeWhere(func(s *Session) bool { return now.After(s.Expires) })
+}
+
+// StartReaper reaps expired sessions every interval until stop is called
+func (m *SessionManager) StartReaper(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if n := m.Reap(); n > 0 {
+					log.Printf("Reaped %d expired sessions", n)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+func (m *SessionManager) removeWhere(match func(*Session) bool) int {
+	var keys []string
+
+	m.mu.Lock()
+	for key, session := range m.sessions {
+		if match(session) {
+			keys = append(keys, key)
+			delete(m.sessions, key)
+			delete(m.persisted, key)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, key := range keys {
+		m.remove(key)
+	}
+	return len(keys)
+}
+
+func (m *SessionManager) expiry(created, now time.Time) time.Time {
+	expires := now.Add(m.idleTimeout)
+	if limit := created.Add(m.maxLifetime); expires.After(limit) {
+		return limit
+	}
+	return expires
+}
+
+func (m *SessionManager) persist(key string, session *Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Put([]byte(key), data)
+	})
+}
+
+func (m *SessionManager) remove(key string) {
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Delete([]byte(key))
+	})
+	if err != nil {
+		log.Printf("Failed to delete session: %v", err)
+	}
+}
+
+// hashToken returns the hex SHA-256 digest used to index bearer tokens
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetSessions lists active sessions; admins see everyone, others only their own
+func GetSessions(c *gin.Context) {
+	currentUser := c.MustGet("user").(*User)
+
+	userID := currentUser.ID
+	if hasPermission(c, PermSessionsAdmin) {
+		userID = 0
+		if username := c.Query("username"); username != "" {
+			user, err := userStore.GetUser(username)
+			if err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+				return
+			}
+			userID = user.ID
+		}
+	}
+
+	list := sessionManager.List(userID)
+	if list == nil {
+		list = []Session{}
+	}
+
+	current := ""
+	if session, ok := c.Get("session"); ok {
+		current = session.(*Session).ID
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"sessions": list,
+		"current":  current,
+	})
+}
+
+// RevokeSession ends a session; users may only revoke their own
+func RevokeSession(c *gin.Context) {
+	currentUser := c.MustGet("user").(*User)
+
+	session, err := sessionManager.Get(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	if !hasPermission(c, PermSessionsAdmin) && session.UserID != currentUser.ID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	if err := sessionManager.Revoke(session.ID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked successfully"})
+}
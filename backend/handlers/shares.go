@@ -0,0 +1,917 @@
+package handlers
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Share modes
+const (
+	// ShareModeDownload lets visitors browse and download
+	ShareModeDownload = "download"
+	// ShareModeUpload is a drop box: visitors can add files to a folder but
+	// not see what is in it
+	ShareModeUpload = "upload"
+)
+
+// shareGrantTTL is how long a visitor stays unlocked after entering a
+// share's password
+const shareGrantTTL = time.Hour
+
+// shareGrantHeader carries an unlock grant for clients that do not keep
+// cookies
+const shareGrantHeader = "X-Share-Grant"
+
+// shareResumeHeader carries a resume grant, issued with each counted
+// download of a file, for clients that do not keep cookies
+const shareResumeHeader = "X-Share-Resume"
+
+// shareActionKey names the context value ShareAccessLogger records
+const shareActionKey = "shareAction"
+
+var (
+	ErrShareNotFound   = errors.New("share not found")
+	ErrShareExpired    = errors.New("share has expired")
+	ErrShareExhausted  = errors.New("share download limit reached")
+	ErrShareWrongMode  = errors.New("share does not allow this")
+	ErrSharePathDenied = errors.New("path is outside the share")
+)
+
+var (
+	sharesBucket      = []byte("shares")
+	shareAccessBucket = []byte("share_access")
+)
+
+// Share is a public link to a file or folder. The token is the only
+// credential unless a password is set.
+type Share struct {
+	Token        string     `json:"token"`
+	Path         string     `json:"path"`
+	Name         string     `json:"name"`
+	IsDir        bool       `json:"isDir"`
+	Mode         string     `json:"mode"`
+	OwnerID      int        `json:"ownerId"`
+	Owner        string     `json:"owner"`
+	PasswordHash string     `json:"passwordHash,omitempty"`
+	HasPassword  bool       `json:"hasPassword"`
+	Created      time.Time  `json:"created"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	MaxDownloads int        `json:"maxDownloads,omitempty"`
+	Downloads    int        `json:"downloads"`
+	Uploads      int        `json:"uploads"`
+	URL          string     `json:"url,omitempty"`
+}
+
+// ShareAccess is one entry in a share's access log
+type ShareAccess struct {
+	Time      time.Time `json:"time"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	Action    string    `json:"action"`
+	Path      string    `json:"path,omitempty"`
+	Status    int       `json:"status"`
+}
+
+type CreateShareRequest struct {
+	Path         string     `json:"path" binding:"required"`
+	Mode         string     `json:"mode" binding:"omitempty,oneof=download upload"`
+	Password     string     `json:"password"`
+	ExpiresAt    *time.Time `json:"expiresAt"`
+	MaxDownloads int        `json:"maxDownloads" binding:"min=0"`
+}
+
+type UnlockShareRequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+// shareGrant records that a visitor entered the password for a share or,
+// when file is set, that they may resume a download already counted
+type shareGrant struct {
+	token   string
+	file    string
+	expires time.Time
+}
+
+// ShareManager persists share links and their access logs
+type ShareManager struct {
+	db *bolt.DB
+	// baseURL is where the public /s/ routes are reachable
+	baseURL string
+
+	mu     sync.Mutex
+	grants map[string]shareGrant
+}
+
+var shareManager *ShareManager
+
+// SetShareManager configures the manager used by the share handlers
+func SetShareManager(manager *ShareManager) {
+	shareManager = manager
+}
+
+// NewShareManager creates the share buckets if needed. Links are built by
+// appending the token to baseURL.
+func NewShareManager(db *bolt.DB, baseURL string) (*ShareManager, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(sharesBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(shareAccessBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ShareManager{
+		db:      db,
+		baseURL: strings.TrimSuffix(baseURL, "/") + "/",
+		grants:  make(map[string]shareGrant),
+	}, nil
+}
+
+// Create stores a new share for the canonical path and fills in its token
+func (m *ShareManager) Create(share *Share, password string) error {
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+	share.Token = token[:32]
+	share.Created = time.Now()
+
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		share.PasswordHash = string(hash)
+		share.HasPassword = true
+	}
+
+	return m.put(share)
+}
+
+// Get returns the share for token
+func (m *ShareManager) Get(token string) (*Share, error) {
+	var share Share
+	err := m.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(sharesBucket).Get([]byte(token))
+		if data == nil {
+			return ErrShareNotFound
+		}
+		return json.Unmarshal(data, &share)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &share, nil
+}
+
+// List returns shares owned by ownerID, or every share when ownerID is
+// zero, newest first
+func (m *ShareManager) List(ownerID int) ([]Share, error) {
+	shares := []Share{}
+	err := m.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sharesBucket).ForEach(func(_, v []byte) error {
+			var share Share
+			if err := json.Unmarshal(v, &share); err != nil {
+				return err
+			}
+			if ownerID == 0 || share.OwnerID == ownerID {
+				shares = append(shares, share)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Created.After(shares[j].Created) })
+	return shares, nil
+}
+
+// Delete removes a share and its access log
+func (m *ShareManager) Delete(token string) error {
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(sharesBucket)
+		if b.Get([]byte(token)) == nil {
+			return ErrShareNotFound
+		}
+		if err := b.Delete([]byte(token)); err != nil {
+			return err
+		}
+		err := tx.Bucket(shareAccessBucket).DeleteBucket([]byte(token))
+		if errors.Is(err, bolt.ErrBucketNotFound) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	for id, grant := range m.grants {
+		if grant.token == token {
+			delete(m.grants, id)
+		}
+	}
+	m.mu.Unlock()
+	return nil
+}
+
+// ClaimDownload counts a download against the share's limit, failing once
+// the limit has been reached
+func (m *ShareManager) ClaimDownload(token string) error {
+	return m.update(token, func(share *Share) error {
+		if share.MaxDownloads > 0 && share.Downloads >= share.MaxDownloads {
+			return ErrShareExhausted
+		}
+		share.Downloads++
+		return nil
+	})
+}
+
+// RecordUpload counts a file dropped into an upload share
+func (m *ShareManager) RecordUpload(token string) error {
+	return m.update(token, func(share *Share) error {
+		share.Uploads++
+		return nil
+	})
+}
+
+// LogAccess appends an entry to the share's access log
+func (m *ShareManager) LogAccess(token string, entry ShareAccess) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return m.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(shareAccessBucket).CreateBucketIfNotExists([]byte(token))
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return b.Put(key, data)
+	})
+}
+
+// AccessLog returns the share's access log, newest first
+func (m *ShareManager) AccessLog(token string) ([]ShareAccess, error) {
+	entries := []ShareAccess{}
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(shareAccessBucket).Bucket([]byte(token))
+		if b == nil {
+			return nil
+		}
+		cursor := b.Cursor()
+		for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+			var entry ShareAccess
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// Unlock checks password against the share and returns a grant that
+// unlocks it for shareGrantTTL
+func (m *ShareManager) Unlock(share *Share, password string) (string, error) {
+	if bcrypt.CompareHashAndPassword([]byte(share.PasswordHash), []byte(password)) != nil {
+		return "", ErrInvalidCredentials
+	}
+
+	return m.grant(share, "")
+}
+
+// Unlocked reports whether grant was issued for the share and is current
+func (m *ShareManager) Unlocked(share *Share, grant string) bool {
+	if share.PasswordHash == "" {
+		return true
+	}
+	return m.granted(share, grant, "")
+}
+
+// GrantResume lets the visitor resume a download of file, identified by
+// its path and ETag, for shareGrantTTL without it counting again
+func (m *ShareManager) GrantResume(share *Share, file string) (string, error) {
+	return m.grant(share, file)
+}
+
+// Resumable reports whether grant lets its holder resume file
+func (m *ShareManager) Resumable(share *Share, grant, file string) bool {
+	return m.granted(share, grant, file)
+}
+
+func (m *ShareManager) grant(share *Share, file string) (string, error) {
+	id, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, grant := range m.grants {
+		if now.After(grant.expires) {
+			delete(m.grants, key)
+		}
+	}
+	m.grants[id] = shareGrant{token: share.Token, file: file, expires: now.Add(shareGrantTTL)}
+	return id, nil
+}
+
+func (m *ShareManager) granted(share *Share, grant, file string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g, ok := m.grants[grant]
+	return ok && g.token == share.Token && g.file == file && time.Now().Before(g.expires)
+}
+
+// Link returns the public URL of a share
+func (m *ShareManager) Link(token string) string {
+	return m.baseURL + token
+}
+
+func (m *ShareManager) update(token string, fn func(*Share) error) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(sharesBucket)
+		data := b.Get([]byte(token))
+		if data == nil {
+			return ErrShareNotFound
+		}
+		var share Share
+		if err := json.Unmarshal(data, &share); err != nil {
+			return err
+		}
+		if err := fn(&share); err != nil {
+			return err
+		}
+		data, err := json.Marshal(&share)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(token), data)
+	})
+}
+
+func (m *ShareManager) put(share *Share) error {
+	data, err := json.Marshal(share)
+	if err != nil {
+		return err
+	}
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sharesBucket).Put([]byte(share.Token), data)
+	})
+}
+
+// view returns a copy of the share for API responses, without the
+// password hash and with its link filled in
+func (share Share) view() Share {
+	share.PasswordHash = ""
+	share.URL = shareManager.Link(share.Token)
+	return share
+}
+
+func (share *Share) expired() bool {
+	return share.ExpiresAt != nil && time.Now().After(*share.ExpiresAt)
+}
+
+// GetShares lists the caller's share links; user admins see everyone's
+func GetShares(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	ownerID := user.ID
+	if hasPermission(c, PermUsersAdmin) && c.Query("all") == "true" {
+		ownerID = 0
+	}
+
+	shares, err := shareManager.List(ownerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot load shares"})
+		return
+	}
+	for i := range shares {
+		shares[i] = shares[i].view()
+	}
+
+	c.JSON(http.StatusOK, gin.H{"shares": shares})
+}
+
+// CreateShare creates a public link to a file or folder
+func CreateShare(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	var req CreateShareRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = ShareModeDownload
+	}
+
+	resolved, ok := resolveRequestPath(c, req.Path)
+	if !ok {
+		return
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if !requireAccess(c, resolved, ACLShare) {
+		return
+	}
+
+	if req.Mode == ShareModeUpload {
+		if !info.IsDir() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Upload links must point to a folder"})
+			return
+		}
+		if !hasPermission(c, PermFilesWrite) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+			return
+		}
+		if req.MaxDownloads > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Upload links have no downloads to limit"})
+			return
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expiry must be in the future"})
+		return
+	}
+
+	share := &Share{
+		Path:         resolved,
+		Name:         info.Name(),
+		IsDir:        info.IsDir(),
+		Mode:         req.Mode,
+		OwnerID:      user.ID,
+		Owner:        user.Username,
+		ExpiresAt:    req.ExpiresAt,
+		MaxDownloads: req.MaxDownloads,
+	}
+	if err := shareManager.Create(share, req.Password); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot create share"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"share": share.view()})
+}
+
+// DeleteShare revokes a share link
+func DeleteShare(c *gin.Context) {
+	share, ok := ownedShare(c)
+	if !ok {
+		return
+	}
+
+	if err := shareManager.Delete(share.Token); err != nil {
+		writeShareError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Share deleted successfully"})
+}
+
+// GetShareAccessLog lists visits to a share link, newest first
+func GetShareAccessLog(c *gin.Context) {
+	share, ok := ownedShare(c)
+	if !ok {
+		return
+	}
+
+	entries, err := shareManager.AccessLog(share.Token)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot load access log"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
+
+// ownedShare loads :token and checks the caller may manage it
+func ownedShare(c *gin.Context) (*Share, bool) {
+	user := c.MustGet("user").(*User)
+
+	share, err := shareManager.Get(c.Param("token"))
+	if err == nil && share.OwnerID != user.ID && !hasPermission(c, PermUsersAdmin) {
+		err = ErrShareNotFound
+	}
+	if err != nil {
+		writeShareError(c, err)
+		return nil, false
+	}
+	return share, true
+}
+
+// GetPublicShare describes a share link to an anonymous visitor. For
+// folders shared for download, ?path= lists a folder below the share.
+func GetPublicShare(c *gin.Context) {
+	share, owner, root, ok := openShare(c, "view")
+	if !ok {
+		return
+	}
+
+	response := gin.H{"share": publicShareInfo(share)}
+	if share.IsDir && share.Mode == ShareModeDownload {
+		dir, rel, err := sharePath(owner, root, c.Query("path"))
+		if err != nil {
+			writeShareError(c, err)
+			return
+		}
+		files, err := listShareFolder(owner, root, dir, rel)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+			return
+		}
+		response["path"] = rel
+		response["files"] = files
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// UnlockPublicShare exchanges a share's password for a grant, returned
+// both as a cookie and in the body for clients that send X-Share-Grant
+func UnlockPublicShare(c *gin.Context) {
+	share, err := shareManager.Get(c.Param("token"))
+	if err != nil || share.expired() {
+		writeShareError(c, ErrShareNotFound)
+		return
+	}
+	c.Set(shareActionKey, "unlock")
+
+	key := share.Token + " " + c.ClientIP()
+	if rejectIfLimited(c, shareLimiter, key, "") {
+		return
+	}
+
+	var req UnlockShareRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if share.PasswordHash == "" {
+		c.JSON(http.StatusOK, gin.H{"message": "Share has no password"})
+		return
+	}
+
+	grant, err := shareManager.Unlock(share, req.Password)
+	if err != nil {
+		shareLimiter.Fail(key, "")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Incorrect password"})
+		return
+	}
+	shareLimiter.Succeed(key)
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(shareCookieName(share.Token), grant, int(shareGrantTTL.Seconds()), "/s/"+share.Token, "", c.Request.TLS != nil, true)
+	c.JSON(http.StatusOK, gin.H{"grant": grant, "expiresIn": int(shareGrantTTL.Seconds())})
+}
+
+// DownloadPublicShare serves a shared file, or for folder shares the file
+// at ?path=. Folders are sent as an archive in ?format=zip or tar.gz. Each
+// download counts against the share's limit; only a range request resuming
+// an unchanged file by the client that was counted for it does not.
+func DownloadPublicShare(c *gin.Context) {
+	share, owner, root, ok := openShare(c, "download")
+	if !ok {
+		return
+	}
+	if share.Mode != ShareModeDownload {
+		writeShareError(c, ErrShareWrongMode)
+		return
+	}
+
+	target, rel, err := sharePath(owner, root, c.Query("path"))
+	if err != nil {
+		writeShareError(c, err)
+		return
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	format := c.DefaultQuery("format", "zip")
+	if info.IsDir() && format != "zip" && format != "tar.gz" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported archive format"})
+		return
+	}
+
+	// Resumes are only free for whoever was counted for the download
+	file := target + " " + fileETag(info)
+	resume := c.GetHeader(shareResumeHeader)
+	if resume == "" {
+		resume, _ = c.Cookie(shareResumeCookieName(share.Token))
+	}
+	if countsAsDownload(c.Request, info, shareManager.Resumable(share, resume, file)) {
+		if err := shareManager.ClaimDownload(share.Token); err != nil {
+			writeShareError(c, err)
+			return
+		}
+		if !info.IsDir() {
+			grant, err := shareManager.GrantResume(share, file)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot start download"})
+				return
+			}
+			c.Header(shareResumeHeader, grant)
+			c.SetSameSite(http.SameSiteLaxMode)
+			c.SetCookie(shareResumeCookieName(share.Token), grant, int(shareGrantTTL.Seconds()), "/s/"+share.Token, "", c.Request.TLS != nil, true)
+		}
+	}
+
+	if info.IsDir() {
+		name := share.Name
+		if rel != "/" {
+			name = path.Base(rel)
+		}
+		streamArchive(c, []archiveEntry{{path: target, name: name, within: root, user: owner}}, "", format)
+		return
+	}
+	serveFile(c, target, info.Name(), c.DefaultQuery("disposition", "attachment"))
+}
+
+// UploadPublicShare adds files to a drop box share. Existing files are
+// never replaced; clashing names are numbered instead.
+func UploadPublicShare(c *gin.Context) {
+	share, _, root, ok := openShare(c, "upload")
+	if !ok {
+		return
+	}
+	if share.Mode != ShareModeUpload {
+		writeShareError(c, ErrShareWrongMode)
+		return
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil || len(form.File["file"]) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
+		return
+	}
+
+	var names []string
+	for _, header := range form.File["file"] {
+		name := filepath.Base(header.Filename)
+		if name == "." || name == ".." || name == string(filepath.Separator) || strings.HasPrefix(name, ".") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file name: " + header.Filename})
+			return
+		}
+
+		// Files dropped in count against the owner of the share
+		dest := availableName(filepath.Join(root, name))
+		if !checkQuota(c, share.Owner, dest, header.Size) {
+			return
+		}
+
+		file, err := header.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot read upload"})
+			return
+		}
+		err = saveFile(file, dest)
+		file.Close()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot save file"})
+			return
+		}
+		chargeFile(dest, share.Owner)
+
+		shareManager.RecordUpload(share.Token)
+		names = append(names, filepath.Base(dest))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Files uploaded successfully",
+		"files":   names,
+	})
+}
+
+// openShare loads the share for :token and checks it may be used: it must
+// not have expired, its owner must still be allowed to share the files,
+// and a password-protected share must be unlocked. root is the share's
+// current canonical path.
+func openShare(c *gin.Context, action string) (share *Share, owner *User, root string, ok bool) {
+	share, err := shareManager.Get(c.Param("token"))
+	if err != nil {
+		writeShareError(c, err)
+		return nil, nil, "", false
+	}
+	c.Set(shareActionKey, action)
+
+	if share.expired() {
+		writeShareError(c, ErrShareExpired)
+		return share, nil, "", false
+	}
+
+	perm, folderPerm := PermFilesRead, ACLRead
+	if share.Mode == ShareModeUpload {
+		perm, folderPerm = PermFilesWrite, ACLWrite
+	}
+	owner, err = userStore.GetUserByID(share.OwnerID)
+	if err != nil || !roleManager.Permissions(owner)[perm] {
+		writeShareError(c, ErrShareNotFound)
+		return share, nil, "", false
+	}
+
+	grant := c.GetHeader(shareGrantHeader)
+	if grant == "" {
+		grant, _ = c.Cookie(shareCookieName(share.Token))
+	}
+	if !shareManager.Unlocked(share, grant) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Password required", "passwordRequired": true})
+		return share, nil, "", false
+	}
+
+	// The shared path may since have been replaced by a link elsewhere
+	root, _, err = storage.Resolve(share.Path)
+	if err != nil || !aclManager.Allowed(owner, root, folderPerm) {
+		writeShareError(c, ErrShareNotFound)
+		return share, nil, "", false
+	}
+	if info, err := os.Stat(root); err != nil || info.IsDir() != share.IsDir {
+		writeShareError(c, ErrShareNotFound)
+		return share, nil, "", false
+	}
+	return share, owner, root, true
+}
+
+// ShareAccessLogger records requests to existing shares in their access
+// log, with the status of the response the handler sent
+func ShareAccessLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		action := c.GetString(shareActionKey)
+		if action == "" {
+			return
+		}
+		token := c.Param("token")
+		entry := ShareAccess{
+			Time:      time.Now(),
+			IP:        c.ClientIP(),
+			UserAgent: c.Request.UserAgent(),
+			Action:    action,
+			Path:      c.Query("path"),
+			Status:    c.Writer.Status(),
+		}
+		if err := shareManager.LogAccess(token, entry); err != nil {
+			log.Printf("Failed to log access to share %s: %v", token[:8], err)
+		}
+	}
+}
+
+// sharePath resolves rel, a slash-separated path relative to the share,
+// and returns it along with its cleaned form. Symlinks may not lead out of
+// the shared folder, and folders the owner may no longer read are off
+// limits.
+func sharePath(owner *User, root, rel string) (string, string, error) {
+	clean := path.Clean("/" + rel)
+	if clean == "/" {
+		return root, clean, nil
+	}
+
+	resolved, _, err := storage.Resolve(filepath.Join(root, filepath.FromSlash(clean)))
+	if err != nil || !isWithin(root, resolved) || !aclManager.Allowed(owner, resolved, ACLRead) {
+		return "", "", ErrSharePathDenied
+	}
+	return resolved, clean, nil
+}
+
+// listShareFolder lists dir with paths relative to the share so that no
+// server paths are exposed
+func listShareFolder(owner *User, root, dir, rel string) ([]FileInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []FileInfo{}
+	for _, entry := range entries {
+		full := filepath.Join(dir, entry.Name())
+		if storage.IsReserved(full) || isTemporaryName(entry.Name()) {
+			continue
+		}
+		// Links are shown as what they point to, and hidden when that is
+		// outside the share
+		target, _, err := sharePath(owner, root, path.Join(rel, entry.Name()))
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(target)
+		if err != nil {
+			continue
+		}
+
+		file := FileInfo{
+			Name:    entry.Name(),
+			Path:    path.Join(rel, entry.Name()),
+			Size:    info.Size(),
+			IsDir:   info.IsDir(),
+			ModTime: info.ModTime(),
+		}
+		if info.IsDir() {
+			file.Category = CategoryFolder
+		} else {
+			file.MimeType = detectMimeType(target)
+			file.Category = fileCategory(entry.Name(), file.MimeType)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// publicShareInfo is what anonymous visitors learn about a share
+func publicShareInfo(share *Share) gin.H {
+	info := gin.H{
+		"name":        share.Name,
+		"isDir":       share.IsDir,
+		"mode":        share.Mode,
+		"owner":       share.Owner,
+		"hasPassword": share.HasPassword,
+		"expiresAt":   share.ExpiresAt,
+	}
+	if share.MaxDownloads > 0 {
+		info["downloadsRemaining"] = max(share.MaxDownloads-share.Downloads, 0)
+	}
+	return info
+}
+
+// countsAsDownload reports whether a request starts a new download. Only
+// HEAD and a genuine resume are free: a single range on a file starting
+// past its first byte, with an If-Range naming the current contents, from
+// a client whose earlier download of it was counted, as resumable says.
+// Folder archives are built afresh and ignore ranges, so they always count.
+func countsAsDownload(r *http.Request, info fs.FileInfo, resumable bool) bool {
+	if r.Method == http.MethodHead {
+		return false
+	}
+	if info.IsDir() || !resumable || r.Header.Get("If-Range") != fileETag(info) {
+		return true
+	}
+
+	spec, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return true
+	}
+	start, _, ok := strings.Cut(spec, "-")
+	if !ok {
+		return true
+	}
+	// Suffix ranges such as "-500" have no start and fail to parse
+	offset, err := strconv.ParseInt(start, 10, 64)
+	return err != nil || offset <= 0 || offset >= info.Size()
+}
+
+func shareCookieName(token string) string {
+	return "nas_share_" + token[:8]
+}
+
+func shareResumeCookieName(token string) string {
+	return "nas_share_resume_" + token[:8]
+}
+
+func writeShareError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrShareNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share not found"})
+	case errors.Is(err, ErrShareExpired):
+		c.JSON(http.StatusGone, gin.H{"error": "Share link has expired"})
+	case errors.Is(err, ErrShareExhausted):
+		c.JSON(http.StatusGone, gin.H{"error": "Download limit reached"})
+	case errors.Is(err, ErrShareWrongMode):
+		c.JSON(http.StatusForbidden, gin.H{"error": "This link does not allow that"})
+	case errors.Is(err, ErrSharePathDenied):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Path is outside the share"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Share operation failed"})
+	}
+}
@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	ErrInvalidPath    = errors.New("invalid path")
+	ErrOutsideStorage = errors.New("path is outside the storage volumes")
+)
+
+// StorageRoot is a volume that the file handlers may operate in
+type StorageRoot struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// StorageResolver maps user-supplied paths to canonical paths inside the
+// configured storage roots. Symlinks are resolved before the containment
+// check so that a link cannot be used to escape a root.
+type StorageResolver struct {
+	roots []StorageRoot
+}
+
+var storage *StorageResolver
+
+// SetStorageResolver configures the volumes available to file handlers
+func SetStorageResolver(resolver *StorageResolver) {
+	storage = resolver
+}
+
+// NewStorageResolver canonicalizes each root; roots must exist
+func NewStorageResolver(roots []StorageRoot) (*StorageResolver, error) {
+	if len(roots) == 0 {
+		return nil, errors.New("no storage roots configured")
+	}
+
+	r := &StorageResolver{}
+	for _, root := range roots {
+		abs, err := filepath.Abs(root.Path)
+		if err != nil {
+			return nil, err
+		}
+		canonical, err := filepath.EvalSymlinks(abs)
+		if err != nil {
+			return nil, fmt.Errorf("storage root %s: %w", root.Path, err)
+		}
+		info, err := os.Stat(canonical)
+		if err != nil {
+			return nil, fmt.Errorf("storage root %s: %w", root.Path, err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("storage root %s is not a directory", root.Path)
+		}
+
+		if root.Name == "" {
+			root.Name = filepath.Base(canonical)
+		}
+		root.Path = canonical
+		r.roots = append(r.roots, root)
+	}
+	return r, nil
+}
+
+// Roots returns the configured volumes
+func (r *StorageResolver) Roots() []StorageRoot {
+	return append([]StorageRoot(nil), r.roots...)
+}
+
+// Default returns the path of the first volume
+func (r *StorageResolver) Default() string {
+	return r.roots[0].Path
+}
+
+// Resolve returns the canonical form of p, following symlinks in every
+// component. p need not exist yet, in which case its deepest existing
+// ancestor is resolved and the remainder appended.
+func (r *StorageResolver) Resolve(p string) (string, *StorageRoot, error) {
+	clean, err := cleanStoragePath(p)
+	if err != nil {
+		return "", nil, err
+	}
+
+	resolved, err := resolveExisting(clean)
+	if err != nil {
+		return "", nil, err
+	}
+	return r.contain(resolved)
+}
+
+// ResolveEntry is like Resolve but does not follow a symlink in the final
+// component, so that operations such as delete act on the link itself
+func (r *StorageResolver) ResolveEntry(p string) (string, *StorageRoot, error) {
+	clean, err := cleanStoragePath(p)
+	if err != nil {
+		return "", nil, err
+	}
+
+	parent, err := resolveExisting(filepath.Dir(clean))
+	if err != nil {
+		return "", nil, err
+	}
+	return r.contain(filepath.Join(parent, filepath.Base(clean)))
+}
+
+// IsRoot reports whether a canonical path is one of the volumes themselves
+func (r *StorageResolver) IsRoot(path string) bool {
+	for _, root := range r.roots {
+		if root.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// IsReserved reports whether a canonical path is one of the hidden folders
+// the server keeps inside a volume, such as the trash
+func (r *StorageResolver) IsReserved(path string) bool {
+	for _, root := range r.roots {
+		if isWithin(filepath.Join(root.Path, trashDirName), path) || isWithin(filepath.Join(root.Path, versionsDirName), path) {
+			return true
+		}
+	}
+	return false
+}
+
+// contain returns the root holding a canonical path. Reserved folders are
+// treated as outside every root.
+func (r *StorageResolver) contain(resolved string) (string, *StorageRoot, error) {
+	if r.IsReserved(resolved) {
+		return "", nil, ErrOutsideStorage
+	}
+	for i := range r.roots {
+		if isWithin(r.roots[i].Path, resolved) {
+			return resolved, &r.roots[i], nil
+		}
+	}
+	return "", nil, ErrOutsideStorage
+}
+
+func cleanStoragePath(p string) (string, error) {
+	if p == "" || strings.ContainsRune(p, 0) || !filepath.IsAbs(p) {
+		return "", ErrInvalidPath
+	}
+	return filepath.Clean(p), nil
+}
+
+// resolveExisting evaluates symlinks in the deepest existing ancestor of an
+// absolute clean path and appends the components that do not exist yet
+func resolveExisting(clean string) (string, error) {
+	existing := clean
+	var missing []string
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			for i := len(missing) - 1; i >= 0; i-- {
+				resolved = filepath.Join(resolved, missing[i])
+			}
+			return resolved, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return "", err
+		}
+		missing = append(missing, filepath.Base(existing))
+		existing = parent
+	}
+}
+
+// isWithin reports whether path equals root or lies beneath it
+func isWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// renameOrCopy moves src to dst, replacing dst. When they are on different
+// filesystems the data is copied to a temporary file beside dst first so
+// that dst only ever appears complete.
+func renameOrCopy(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*.part")
+	if err != nil {
+		return err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Remove(src)
+}
+
+// resolveRequestPath resolves p for a handler, writing the error response
+// and returning false when the path is not allowed
+func resolveRequestPath(c *gin.Context, p string) (string, bool) {
+	resolved, _, err := storage.Resolve(p)
+	return checkResolved(c, resolved, err)
+}
+
+// resolveRequestEntry is resolveRequestPath without following a final symlink
+func resolveRequestEntry(c *gin.Context, p string) (string, bool) {
+	resolved, _, err := storage.ResolveEntry(p)
+	return checkResolved(c, resolved, err)
+}
+
+func checkResolved(c *gin.Context, resolved string, err error) (string, bool) {
+	switch {
+	case err == nil:
+		return resolved, true
+	case errors.Is(err, ErrOutsideStorage):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Path is outside the storage volumes"})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid path"})
+	}
+	return "", false
+}
+
+// GetStorageRoots lists the volumes available to the file manager
+func GetStorageRoots(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"roots": storage.Roots()})
+}
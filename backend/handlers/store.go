@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("user already exists")
+)
+
+// UserStore persists user accounts together with their password hashes
+type UserStore interface {
+	GetUser(username string) (*User, error)
+	GetUserByID(id int) (*User, error)
+	GetUserBySubject(issuer, subject string) (*User, error)
+	ListUsers() ([]User, error)
+	CreateUser(user *User, passwordHash string) error
+	UpdateUser(user *User) error
+	SetEmail(username string, email string) error
+	DeleteUser(username string) error
+	GetPasswordHash(username string) (string, error)
+	SetPasswordHash(username string, passwordHash string) error
+	GetTwoFactor(username string) (*TwoFactorSecrets, error)
+	SetTwoFactor(username string, secrets *TwoFactorSecrets) error
+}
+
+// TwoFactorSecrets holds a user's TOTP state. Recovery codes are stored as
+// SHA-256 hashes and removed once used.
+type TwoFactorSecrets struct {
+	Secret        string   `json:"secret,omitempty"`
+	PendingSecret string   `json:"pendingSecret,omitempty"`
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+	LastCounter   int64    `json:"lastCounter,omitempty"`
+}
+
+var (
+	usersBucket     = []byte("users")
+	usersByIDBucket = []byte("users_by_id")
+)
+
+// userRecord is the on-disk representation of a user
+type userRecord struct {
+	User
+	PasswordHash string            `json:"passwordHash"`
+	TwoFactor    *TwoFactorSecrets `json:"twoFactor,omitempty"`
+}
+
+// BoltUserStore is a UserStore backed by an embedded bbolt database
+type BoltUserStore struct {
+	db *bolt.DB
+}
+
+// NewBoltUserStore creates the user buckets if needed and returns a store
+func NewBoltUserStore(db *bolt.DB) (*BoltUserStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(usersBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(usersByIDBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltUserStore{db: db}, nil
+}
+
+func (s *BoltUserStore) GetUser(username string) (*User, error) {
+	var record *userRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		record, err = getUserRecord(tx, username)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &record.User, nil
+}
+
+func (s *BoltUserStore) GetUserByID(id int) (*User, error) {
+	var record *userRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		username := tx.Bucket(usersByIDBucket).Get(idKey(id))
+		if username == nil {
+			return ErrUserNotFound
+		}
+		var err error
+		record, err = getUserRecord(tx, string(username))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &record.User, nil
+}
+
+// GetUserBySubject finds the single sign-on account bound to subject at issuer
+func (s *BoltUserStore) GetUserBySubject(issuer, subject string) (*User, error) {
+	var user *User
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEach(func(_, v []byte) error {
+			var record userRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			if record.Subject == subject && record.Issuer == issuer {
+				user = &record.User
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (s *BoltUserStore) ListUsers() ([]User, error) {
+	var users []User
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEach(func(_, v []byte) error {
+			var record userRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			users = append(users, record.User)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+// CreateUser assigns the next free ID to user and stores it
+func (s *BoltUserStore) CreateUser(user *User, passwordHash string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usersBucket)
+		if b.Get([]byte(user.Username)) != nil {
+			return ErrUserExists
+		}
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		user.ID = int(seq)
+
+		if err := putUserRecord(tx, &userRecord{User: *user, PasswordHash: passwordHash}); err != nil {
+			return err
+		}
+		return tx.Bucket(usersByIDBucket).Put(idKey(user.ID), []byte(user.Username))
+	})
+}
+
+// UpdateUser overwrites the stored profile fields of an existing user
+func (s *BoltUserStore) UpdateUser(user *User) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		record, err := getUserRecord(tx, user.Username)
+		if err != nil {
+			return err
+		}
+		record.User = *user
+		return putUserRecord(tx, record)
+	})
+}
+
+// SetEmail changes only the email address, leaving concurrent edits to other
+// fields intact
+func (s *BoltUserStore) SetEmail(username string, email string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		record, err := getUserRecord(tx, username)
+		if err != nil {
+			return err
+		}
+		record.Email = email
+		return putUserRecord(tx, record)
+	})
+}
+
+func (s *BoltUserStore) DeleteUser(username string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		record, err := getUserRecord(tx, username)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(usersByIDBucket).Delete(idKey(record.ID)); err != nil {
+			return err
+		}
+		return tx.Bucket(usersBucket).Delete([]byte(username))
+	})
+}
+
+func (s *BoltUserStore) GetPasswordHash(username string) (string, error) {
+	var hash string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		record, err := getUserRecord(tx, username)
+		if err != nil {
+			return err
+		}
+		hash = record.PasswordHash
+		return nil
+	})
+	return hash, err
+}
+
+func (s *BoltUserStore) SetPasswordHash(username string, passwordHash string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		record, err := getUserRecord(tx, username)
+		if err != nil {
+			return err
+		}
+		record.PasswordHash = passwordHash
+		return putUserRecord(tx, record)
+	})
+}
+
+// GetTwoFactor returns the user's TOTP state, which is empty when never enrolled
+func (s *BoltUserStore) GetTwoFactor(username string) (*TwoFactorSecrets, error) {
+	secrets := &TwoFactorSecrets{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		record, err := getUserRecord(tx, username)
+		if err != nil {
+			return err
+		}
+		if record.TwoFactor != nil {
+			secrets = record.TwoFactor
+		}
+		return nil
+	})
+	return secrets, err
+}
+
+func (s *BoltUserStore) SetTwoFactor(username string, secrets *TwoFactorSecrets) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		record, err := getUserRecord(tx, username)
+		if err != nil {
+			return err
+		}
+		record.TwoFactor = secrets
+		return putUserRecord(tx, record)
+	})
+}
+
+func getUserRecord(tx *bolt.Tx, username string) (*userRecord, error) {
+	data := tx.Bucket(usersBucket).Get([]byte(username))
+	if data == nil {
+		return nil, ErrUserNotFound
+	}
+	var record userRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func putUserRecord(tx *bolt.Tx, record *userRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(usersBucket).Put([]byte(record.Username), data)
+}
+
+// idKey encodes an integer ID as a sortable bucket key
+func idKey(id int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
@@ -0,0 +1,362 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/draw"
+)
+
+const (
+	// maxThumbnailSource rejects source files larger than this
+	maxThumbnailSource = 100 << 20
+	// maxThumbnailPixels guards against decompression bombs
+	maxThumbnailPixels   = 64 << 20
+	defaultThumbnailSize = 256
+)
+
+// thumbnailSizes are the edge lengths thumbnails are rendered at; requests
+// are rounded up to one of these so the cache stays small
+var thumbnailSizes = []int{64, 128, 256, 512, 1024}
+
+var (
+	ErrThumbnailUnsupported = errors.New("no thumbnail available for this file type")
+	ErrThumbnailBusy        = errors.New("thumbnail queue is full")
+)
+
+// thumbnailRequest is a unit of work for the thumbnail workers
+type thumbnailRequest struct {
+	key    string
+	source string
+	size   int
+	done   chan struct{}
+	path   string
+	err    error
+}
+
+// ThumbnailService renders downscaled previews of images with a bounded
+// pool of workers and caches them on disk keyed by source path, mtime and
+// size. The least recently served thumbnails are evicted once the cache
+// exceeds its size limit.
+type ThumbnailService struct {
+	dir      string
+	maxBytes int64
+	queue    chan *thumbnailRequest
+
+	mu        sync.Mutex
+	inflight  map[string]*thumbnailRequest
+	usedBytes int64
+	evicting  bool
+}
+
+var thumbnailService *ThumbnailService
+
+// SetThumbnailService configures the service used by GetThumbnail
+func SetThumbnailService(service *ThumbnailService) {
+	thumbnailService = service
+}
+
+// NewThumbnailService caches up to maxBytes of thumbnails in dir and
+// renders with the given number of workers
+func NewThumbnailService(dir string, maxBytes int64, workers int) (*ThumbnailService, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &ThumbnailService{
+		dir:      dir,
+		maxBytes: maxBytes,
+		queue:    make(chan *thumbnailRequest, workers*16),
+		inflight: make(map[string]*thumbnailRequest),
+	}
+
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if info, err := d.Info(); err == nil {
+			s.usedBytes += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	return s, nil
+}
+
+// Thumbnail returns the path of a cached thumbnail of source no larger than
+// size on either edge, rendering it first if needed
+func (s *ThumbnailService) Thumbnail(ctx context.Context, source string, info fs.FileInfo, size int) (string, error) {
+	format := thumbnailFormat(source)
+	if format == "" {
+		return "", ErrThumbnailUnsupported
+	}
+
+	key := thumbnailKey(source, info, size)
+	cached := filepath.Join(s.dir, key[:2], key+"."+format)
+	if _, err := os.Stat(cached); err == nil {
+		// Bump the mtime so eviction sees this as recently used
+		now := time.Now()
+		os.Chtimes(cached, now, now)
+		return cached, nil
+	}
+
+	// Share the work when the same thumbnail is requested concurrently
+	s.mu.Lock()
+	req, exists := s.inflight[key]
+	if !exists {
+		req = &thumbnailRequest{key: key, source: source, size: size, done: make(chan struct{}), path: cached}
+		select {
+		case s.queue <- req:
+			s.inflight[key] = req
+		default:
+			s.mu.Unlock()
+			return "", ErrThumbnailBusy
+		}
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-req.done:
+		return req.path, req.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (s *ThumbnailService) work() {
+	for req := range s.queue {
+		req.err = s.render(req.source, req.path, req.size)
+
+		s.mu.Lock()
+		delete(s.inflight, req.key)
+		s.mu.Unlock()
+		close(req.done)
+	}
+}
+
+// render decodes source and writes a thumbnail fitting in size×size to dest
+func (s *ThumbnailService) render(source, dest string, size int) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return ErrThumbnailUnsupported
+	}
+	if config.Width*config.Height > maxThumbnailPixels {
+		return fmt.Errorf("image too large: %dx%d", config.Width, config.Height)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return ErrThumbnailUnsupported
+	}
+
+	// Fit within size×size keeping the aspect ratio; never upscale
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, max(h*size/w, 1)
+		} else {
+			w, h = max(w*size/h, 1), size
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".thumb-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if filepath.Ext(dest) == ".png" {
+		err = png.Encode(tmp, dst)
+	} else {
+		err = jpeg.Encode(tmp, dst, &jpeg.Options{Quality: 85})
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(tmp.Name())
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.usedBytes += info.Size()
+	evict := s.usedBytes > s.maxBytes && !s.evicting
+	s.evicting = s.evicting || evict
+	s.mu.Unlock()
+	if evict {
+		go s.evict()
+	}
+	return nil
+}
+
+// evict deletes the least recently used thumbnails until the cache is
+// back under 90% of its limit
+func (s *ThumbnailService) evict() {
+	defer func() {
+		s.mu.Lock()
+		s.evicting = false
+		s.mu.Unlock()
+	}()
+
+	type cachedFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []cachedFile
+	var total int64
+	filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			files = append(files, cachedFile{p, info.Size(), info.ModTime()})
+			total += info.Size()
+		}
+		return nil
+	})
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	target := s.maxBytes * 9 / 10
+	removed := 0
+	for _, file := range files {
+		if total <= target {
+			break
+		}
+		if err := os.Remove(file.path); err == nil {
+			total -= file.size
+			removed++
+		}
+	}
+
+	s.mu.Lock()
+	s.usedBytes = total
+	s.mu.Unlock()
+	log.Printf("Evicted %d thumbnails, cache now %d bytes", removed, total)
+}
+
+// thumbnailFormat returns the cache file extension for source, keeping
+// transparency for PNG and GIF, or "" when it cannot be thumbnailed
+func thumbnailFormat(source string) string {
+	switch detectMimeType(source) {
+	case "image/jpeg":
+		return "jpg"
+	case "image/png", "image/gif":
+		return "png"
+	default:
+		return ""
+	}
+}
+
+func thumbnailKey(source string, info fs.FileInfo, size int) string {
+	sum := sha256.Sum256([]byte(source + "\x00" + strconv.FormatInt(info.ModTime().UnixNano(), 10) + "\x00" + strconv.Itoa(size)))
+	return hex.EncodeToString(sum[:])
+}
+
+// thumbnailSize rounds a requested edge length up to a rendered size
+func thumbnailSize(requested int) int {
+	for _, size := range thumbnailSizes {
+		if requested <= size {
+			return size
+		}
+	}
+	return thumbnailSizes[len(thumbnailSizes)-1]
+}
+
+// GetThumbnail serves a downscaled preview of an image. ?size= is the
+// longest edge in pixels.
+func GetThumbnail(c *gin.Context) {
+	source, ok := resolveRequestPath(c, c.Query("path"))
+	if !ok {
+		return
+	}
+	if !requireAccess(c, source, ACLRead) {
+		return
+	}
+
+	size := defaultThumbnailSize
+	if v := c.Query("size"); v != "" {
+		requested, err := strconv.Atoi(v)
+		if err != nil || requested < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid size"})
+			return
+		}
+		size = thumbnailSize(requested)
+	}
+
+	info, err := os.Stat(source)
+	if err != nil || info.IsDir() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if info.Size() > maxThumbnailSource {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "File too large for a thumbnail"})
+		return
+	}
+
+	path, err := thumbnailService.Thumbnail(c.Request.Context(), source, info, size)
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrThumbnailUnsupported):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "No thumbnail available for this file type"})
+		return
+	case errors.Is(err, ErrThumbnailBusy):
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Thumbnail service is busy"})
+		return
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot generate thumbnail"})
+		return
+	}
+
+	// The cache key covers path, mtime and size, so it doubles as an ETag
+	c.Header("ETag", `"`+filepath.Base(path)+`"`)
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.File(path)
+}
@@ -0,0 +1,316 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+// apiTokenPrefix distinguishes API tokens from session tokens
+const apiTokenPrefix = "nas_"
+
+// apiTokenTouchInterval limits how often LastUsed is written to disk
+const apiTokenTouchInterval = time.Minute
+
+var (
+	ErrAPITokenNotFound = errors.New("API token not found")
+	ErrAPITokenExpired  = errors.New("API token expired")
+)
+
+var apiTokensBucket = []byte("api_tokens")
+
+// APIToken is a long-lived credential for scripts. Only the SHA-256 of the
+// secret is stored; Scopes, when set, narrow the owner's permissions.
+type APIToken struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	UserID    int        `json:"userId"`
+	Username  string     `json:"username"`
+	Prefix    string     `json:"prefix"`
+	Scopes    []string   `json:"scopes"`
+	Created   time.Time  `json:"created"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	LastUsed  *time.Time `json:"lastUsed,omitempty"`
+}
+
+type CreateAPITokenRequest struct {
+	Name          string   `json:"name" binding:"required"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expiresInDays" binding:"min=0"`
+}
+
+// APITokenStore persists API tokens keyed by the hash of their secret
+type APITokenStore struct {
+	db *bolt.DB
+}
+
+var apiTokenStore *APITokenStore
+
+// SetAPITokenStore configures the store used for API tokens
+func SetAPITokenStore(store *APITokenStore) {
+	apiTokenStore = store
+}
+
+// NewAPITokenStore creates the token bucket if needed and returns a store
+func NewAPITokenStore(db *bolt.DB) (*APITokenStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(apiTokensBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &APITokenStore{db: db}, nil
+}
+
+// Create issues a new token for user and returns its plaintext secret
+func (s *APITokenStore) Create(user *User, name string, scopes []string, expiresAt *time.Time) (string, *APIToken, error) {
+	secret, err := generateToken()
+	if err != nil {
+		return "", nil, err
+	}
+	id, err := generateToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	plaintext := apiTokenPrefix + secret
+	token := &APIToken{
+		ID:        id[:16],
+		Name:      name,
+		UserID:    user.ID,
+		Username:  user.Username,
+		Prefix:    plaintext[:len(apiTokenPrefix)+8],
+		Scopes:    scopes,
+		Created:   time.Now(),
+		ExpiresAt: expiresAt,
+	}
+
+	if err := s.put(hashToken(plaintext), token); err != nil {
+		return "", nil, err
+	}
+	return plaintext, token, nil
+}
+
+// Validate returns the token matching plaintext and records its use
+func (s *APITokenStore) Validate(plaintext string) (*APIToken, error) {
+	key := hashToken(plaintext)
+
+	var token APIToken
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(apiTokensBucket).Get([]byte(key))
+		if data == nil {
+			return ErrAPITokenNotFound
+		}
+		return json.Unmarshal(data, &token)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if token.ExpiresAt != nil && now.After(*token.ExpiresAt) {
+		return nil, ErrAPITokenExpired
+	}
+
+	if token.LastUsed == nil || now.Sub(*token.LastUsed) >= apiTokenTouchInterval {
+		token.LastUsed = &now
+		if err := s.put(key, &token); err != nil {
+			return nil, err
+		}
+	}
+	return &token, nil
+}
+
+// List returns the tokens owned by userID, newest first
+func (s *APITokenStore) List(userID int) ([]APIToken, error) {
+	tokens := []APIToken{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(apiTokensBucket).ForEach(func(_, v []byte) error {
+			var token APIToken
+			if err := json.Unmarshal(v, &token); err != nil {
+				return err
+			}
+			if token.UserID == userID {
+				tokens = append(tokens, token)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Created.After(tokens[j].Created) })
+	return tokens, nil
+}
+
+// Revoke deletes the token with the given ID owned by userID
+func (s *APITokenStore) Revoke(userID int, id string) error {
+	removed, err := s.removeWhere(func(t *APIToken) bool { return t.UserID == userID && t.ID == id })
+	if err == nil && removed == 0 {
+		return ErrAPITokenNotFound
+	}
+	return err
+}
+
+// RevokeUser deletes every token owned by userID
+func (s *APITokenStore) RevokeUser(userID int) error {
+	_, err := s.removeWhere(func(t *APIToken) bool { return t.UserID == userID })
+	return err
+}
+
+func (s *APITokenStore) removeWhere(match func(*APIToken) bool) (int, error) {
+	removed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(apiTokensBucket)
+
+		var keys [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var token APIToken
+			if err := json.Unmarshal(v, &token); err != nil {
+				return err
+			}
+			if match(&token) {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(keys)
+		return nil
+	})
+	return removed, err
+}
+
+func (s *APITokenStore) put(key string, token *APIToken) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(apiTokensBucket).Put([]byte(key), data)
+	})
+}
+
+// isAPIToken reports whether a bearer token should be checked as an API token
+func isAPIToken(token string) bool {
+	return strings.HasPrefix(token, apiTokenPrefix)
+}
+
+// GetAPITokens lists a user's API tokens; admins may list anyone's
+func GetAPITokens(c *gin.Context) {
+	target, ok := tokenOwner(c)
+	if !ok {
+		return
+	}
+
+	tokens, err := apiTokenStore.List(target.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load tokens"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"tokens": tokens})
+}
+
+// CreateAPIToken issues a new token; the secret is only returned once
+func CreateAPIToken(c *gin.Context) {
+	target, ok := tokenOwner(c)
+	if !ok {
+		return
+	}
+
+	currentUser := c.MustGet("user").(*User)
+	if target.ID != currentUser.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Tokens can only be created by their owner"})
+		return
+	}
+
+	var req CreateAPITokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Scopes may only narrow what the caller can already do
+	for _, scope := range req.Scopes {
+		if _, known := AllPermissions[scope]; !known {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown permission: " + scope})
+			return
+		}
+		if !hasPermission(c, scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Cannot grant permission: " + scope})
+			return
+		}
+	}
+	scopes := append([]string{}, req.Scopes...)
+	sort.Strings(scopes)
+
+	var expiresAt *time.Time
+	if req.ExpiresInDays > 0 {
+		t := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		expiresAt = &t
+	}
+
+	plaintext, token, err := apiTokenStore.Create(target, req.Name, scopes, expiresAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create token"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"token":    plaintext,
+		"apiToken": token,
+	})
+}
+
+// RevokeAPIToken deletes one of a user's tokens
+func RevokeAPIToken(c *gin.Context) {
+	target, ok := tokenOwner(c)
+	if !ok {
+		return
+	}
+
+	if err := apiTokenStore.Revoke(target.ID, c.Param("id")); err != nil {
+		if errors.Is(err, ErrAPITokenNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Token revoked successfully"})
+}
+
+// tokenOwner resolves :username and checks the caller may manage its tokens
+func tokenOwner(c *gin.Context) (*User, bool) {
+	currentUser := c.MustGet("user").(*User)
+	username := c.Param("username")
+
+	if username != currentUser.Username && !hasPermission(c, PermUsersAdmin) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return nil, false
+	}
+
+	target, err := userStore.GetUser(username)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return nil, false
+	}
+	return target, true
+}
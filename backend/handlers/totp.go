@@ -0,0 +1,447 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RFC 6238 parameters; these are the defaults every authenticator app supports
+const (
+	totpIssuer   = "NAS OS"
+	totpDigits   = 6
+	totpPeriod   = 30
+	totpSkew     = 1
+	totpKeyBytes = 20
+
+	recoveryCodeCount = 10
+
+	loginChallengeTTL      = 5 * time.Minute
+	loginChallengeAttempts = 5
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type VerifyLoginRequest struct {
+	Challenge string `json:"challenge" binding:"required"`
+	Code      string `json:"code" binding:"required"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// DisableTwoFactorRequest confirms turning 2FA off. Accounts signing in
+// through single sign-on have no password and only send the code.
+type DisableTwoFactorRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code" binding:"required"`
+}
+
+// loginChallenge is a password-verified login waiting for its second factor
+type loginChallenge struct {
+	userID   int
+	expires  time.Time
+	attempts int
+}
+
+var (
+	challengesMu    sync.Mutex
+	loginChallenges = make(map[string]*loginChallenge)
+)
+
+// newLoginChallenge records that user passed the password step
+func newLoginChallenge(user *User) (string, error) {
+	id, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	challengesMu.Lock()
+	defer challengesMu.Unlock()
+
+	for key, challenge := range loginChallenges {
+		if now.After(challenge.expires) {
+			delete(loginChallenges, key)
+		}
+	}
+	loginChallenges[id] = &loginChallenge{
+		userID:  user.ID,
+		expires: now.Add(loginChallengeTTL),
+	}
+	return id, nil
+}
+
+// VerifyLogin completes a two-factor login with a TOTP or recovery code
+func VerifyLogin(c *gin.Context) {
+	var req VerifyLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	challengesMu.Lock()
+	challenge, exists := loginChallenges[req.Challenge]
+	if exists && time.Now().After(challenge.expires) {
+		delete(loginChallenges, req.Challenge)
+		exists = false
+	}
+	if !exists {
+		challengesMu.Unlock()
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge"})
+		return
+	}
+	challenge.attempts++
+	if challenge.attempts > loginChallengeAttempts {
+		delete(loginChallenges, req.Challenge)
+		challengesMu.Unlock()
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Too many attempts"})
+		return
+	}
+	userID := challenge.userID
+	challengesMu.Unlock()
+
+	user, err := userStore.GetUserByID(userID)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge"})
+		return
+	}
+
+	if rejectIfLocked(c, user.Username) {
+		return
+	}
+
+	ok, err := checkSecondFactor(user, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+		return
+	}
+	if !ok {
+		loginLimiter.Fail(user.Username, c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	challengesMu.Lock()
+	delete(loginChallenges, req.Challenge)
+	challengesMu.Unlock()
+
+	completeLogin(c, user)
+}
+
+// SetupTwoFactor generates a new pending TOTP secret for the current user
+func SetupTwoFactor(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+	if user.TwoFactorEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	secrets, err := userStore.GetTwoFactor(user.Username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load two-factor settings"})
+		return
+	}
+
+	key := make([]byte, totpKeyBytes)
+	if _, err := rand.Read(key); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+		return
+	}
+	secrets.PendingSecret = base32NoPadding.EncodeToString(key)
+
+	if err := userStore.SetTwoFactor(user.Username, secrets); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save two-factor settings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":     secrets.PendingSecret,
+		"otpauthUri": totpURI(user.Username, secrets.PendingSecret),
+	})
+}
+
+// EnableTwoFactor confirms the pending secret and issues recovery codes
+func EnableTwoFactor(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	secrets, err := userStore.GetTwoFactor(user.Username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load two-factor settings"})
+		return
+	}
+	if secrets.PendingSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor setup has not been started"})
+		return
+	}
+
+	counter, ok := verifyTOTP(secrets.PendingSecret, req.Code, time.Now(), 0)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+
+	secrets.Secret = secrets.PendingSecret
+	secrets.PendingSecret = ""
+	secrets.RecoveryCodes = hashes
+	secrets.LastCounter = counter
+	if err := userStore.SetTwoFactor(user.Username, secrets); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save two-factor settings"})
+		return
+	}
+
+	user.TwoFactorEnabled = true
+	if err := userStore.UpdateUser(user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":       "Two-factor authentication enabled",
+		"recoveryCodes": codes,
+	})
+}
+
+// DisableTwoFactor turns off 2FA after re-checking both factors
+func DisableTwoFactor(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	var req DisableTwoFactorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !user.TwoFactorEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	if rejectIfLocked(c, user.Username) {
+		return
+	}
+
+	// Directory users are checked against the directory like at login
+	if user.Source != UserSourceOIDC {
+		if _, err := authenticatePassword(user.Username, req.Password); err != nil {
+			if errors.Is(err, ErrInvalidCredentials) || errors.Is(err, ErrLDAPInvalidCredentials) {
+				loginLimiter.Fail(user.Username, c.ClientIP())
+			} else {
+				log.Printf("Password check for %q failed: %v", user.Username, err)
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+			return
+		}
+	}
+
+	ok, err := checkSecondFactor(user, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+		return
+	}
+	if !ok {
+		loginLimiter.Fail(user.Username, c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	if err := resetTwoFactor(user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes of the current user
+func RegenerateRecoveryCodes(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !user.TwoFactorEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	ok, err := checkSecondFactor(user, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+
+	secrets, err := userStore.GetTwoFactor(user.Username)
+	if err == nil {
+		secrets.RecoveryCodes = hashes
+		err = userStore.SetTwoFactor(user.Username, secrets)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save two-factor settings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+// ResetUserTwoFactor lets an admin remove 2FA from a user who lost their device
+func ResetUserTwoFactor(c *gin.Context) {
+	user, err := userStore.GetUser(c.Param("username"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if err := resetTwoFactor(user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication reset"})
+}
+
+func resetTwoFactor(user *User) error {
+	if err := userStore.SetTwoFactor(user.Username, nil); err != nil {
+		return err
+	}
+	user.TwoFactorEnabled = false
+	return userStore.UpdateUser(user)
+}
+
+// checkSecondFactor accepts either a current TOTP code or an unused recovery
+// code, consuming the recovery code or TOTP time step on success
+func checkSecondFactor(user *User, code string) (bool, error) {
+	secrets, err := userStore.GetTwoFactor(user.Username)
+	if err != nil {
+		return false, err
+	}
+	if secrets.Secret == "" {
+		return false, nil
+	}
+
+	if counter, ok := verifyTOTP(secrets.Secret, code, time.Now(), secrets.LastCounter); ok {
+		secrets.LastCounter = counter
+		return true, userStore.SetTwoFactor(user.Username, secrets)
+	}
+
+	hashed := hashToken(normalizeRecoveryCode(code))
+	for i, stored := range secrets.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hashed)) == 1 {
+			secrets.RecoveryCodes = append(secrets.RecoveryCodes[:i], secrets.RecoveryCodes[i+1:]...)
+			return true, userStore.SetTwoFactor(user.Username, secrets)
+		}
+	}
+	return false, nil
+}
+
+// verifyTOTP checks code against the time steps around t, rejecting steps at
+// or before lastCounter so that a code cannot be replayed
+func verifyTOTP(secret, code string, t time.Time, lastCounter int64) (int64, bool) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := t.Unix() / totpPeriod
+	for counter := current - totpSkew; counter <= current+totpSkew; counter++ {
+		if counter <= lastCounter {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// totpCode computes the HOTP value (RFC 4226) for the given counter
+func totpCode(key []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// totpURI builds the otpauth:// URI encoded into enrollment QR codes
+func totpURI(username, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+
+	label := url.PathEscape(totpIssuer + ":" + username)
+	query := strings.ReplaceAll(params.Encode(), "+", "%20")
+	return "otpauth://totp/" + label + "?" + query
+}
+
+// generateRecoveryCodes returns plaintext codes and their stored hashes
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32NoPadding.EncodeToString(raw))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashToken(code)
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
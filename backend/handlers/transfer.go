@@ -0,0 +1,542 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Conflict policies for when a destination name is already taken
+const (
+	ConflictFail      = "fail"
+	ConflictOverwrite = "overwrite"
+	ConflictRename    = "rename"
+)
+
+var ErrDestinationExists = errors.New("destination already exists")
+
+type TransferRequest struct {
+	Paths       []string `json:"paths" binding:"required,min=1"`
+	Destination string   `json:"destination" binding:"required"`
+	Conflict    string   `json:"conflict" binding:"omitempty,oneof=fail overwrite rename"`
+}
+
+type RenameRequest struct {
+	Path     string `json:"path" binding:"required"`
+	Name     string `json:"name" binding:"required"`
+	Conflict string `json:"conflict" binding:"omitempty,oneof=fail overwrite rename"`
+}
+
+// MoveFiles moves files and folders into a destination folder as a
+// background job. Moves within a filesystem are renames; across volumes
+// the data is copied and the source removed afterwards.
+func MoveFiles(c *gin.Context) {
+	startTransfer(c, "move")
+}
+
+// CopyFiles copies files and folders into a destination folder as a
+// background job
+func CopyFiles(c *gin.Context) {
+	startTransfer(c, "copy")
+}
+
+func startTransfer(c *gin.Context, op string) {
+	user := c.MustGet("user").(*User)
+
+	var req TransferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Conflict == "" {
+		req.Conflict = ConflictFail
+	}
+
+	dest, ok := resolveRequestPath(c, req.Destination)
+	if !ok {
+		return
+	}
+	if info, err := os.Stat(dest); err != nil || !info.IsDir() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Destination folder does not exist"})
+		return
+	}
+	if !requireAccess(c, dest, ACLWrite) {
+		return
+	}
+
+	// Moving takes entries away from where they were; copying only needs
+	// to read them
+	sourcePerm := ACLRead
+	if op == "move" {
+		sourcePerm = ACLDelete
+	}
+
+	sources := make([]string, 0, len(req.Paths))
+	var conflicts []string
+	for _, p := range req.Paths {
+		// Symlinks are moved or copied as links, not as what they point to
+		src, ok := resolveRequestEntry(c, p)
+		if !ok {
+			return
+		}
+		info, err := os.Lstat(src)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found: " + p})
+			return
+		}
+		if storage.IsRoot(src) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Cannot " + op + " a storage volume"})
+			return
+		}
+		if info.IsDir() && isWithin(src, dest) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot " + op + " a folder into itself"})
+			return
+		}
+		if !requireTreeAccess(c, src, sourcePerm) {
+			return
+		}
+
+		// Moving an entry to where it already is changes nothing, but a
+		// copy there collides with its own source
+		target := filepath.Join(dest, filepath.Base(src))
+		if _, err := os.Lstat(target); err == nil && (op == "copy" || target != src) {
+			conflicts = append(conflicts, target)
+		}
+		sources = append(sources, src)
+	}
+
+	if req.Conflict == ConflictFail && len(conflicts) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Destination already exists", "conflicts": conflicts})
+		return
+	}
+	// Overwriting deletes what was there
+	if req.Conflict == ConflictOverwrite {
+		for _, target := range conflicts {
+			if !requireTreeAccess(c, target, ACLDelete) {
+				return
+			}
+		}
+	}
+
+	// Copies, and moves to another volume, add to what the caller owns there
+	var added int64
+	for _, src := range sources {
+		if op == "copy" || volumeOf(src) != volumeOf(dest) {
+			_, size, err := measureTree(src)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot read " + src})
+				return
+			}
+			added += size
+		}
+	}
+	if !checkQuota(c, user.Username, dest, added) {
+		return
+	}
+
+	job := &Job{
+		Type:        op,
+		UserID:      user.ID,
+		Username:    user.Username,
+		Sources:     sources,
+		Destination: dest,
+	}
+	err := jobManager.Submit(job, func(ctx context.Context, job *Job) error {
+		return runTransfer(ctx, job, op, sources, dest, req.Conflict)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot start job"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"job": job.snapshot()})
+}
+
+func runTransfer(ctx context.Context, job *Job, op string, sources []string, dest, conflict string) error {
+	// Measure everything first so progress has a stable total
+	var added int64
+	for _, src := range sources {
+		files, bytes, err := measureTree(src)
+		if err != nil {
+			return err
+		}
+		job.AddTotal(files, bytes)
+		if op == "copy" || volumeOf(src) != volumeOf(dest) {
+			added += bytes
+		}
+	}
+
+	// The quota was checked when the job was started, but other writes may
+	// have used the space while it was queued
+	if _, err := quotaManager.Reserve(job.ID, job.Username, dest, added); err != nil {
+		return err
+	}
+	defer quotaManager.Release(job.ID)
+
+	for _, src := range sources {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		target := filepath.Join(dest, filepath.Base(src))
+		if op == "move" && target == src {
+			// Already where it was asked to go
+			files, bytes, _ := measureTree(src)
+			job.Advance(bytes)
+			for i := 0; i < files; i++ {
+				job.FinishFile()
+			}
+			job.AddResult(src)
+			continue
+		}
+
+		overwrite := false
+		if _, err := os.Lstat(target); err == nil {
+			switch conflict {
+			case ConflictOverwrite:
+				overwrite = true
+			case ConflictRename:
+				target = availableName(target)
+			default:
+				return fmt.Errorf("%s: %w", target, ErrDestinationExists)
+			}
+		}
+		if err := transferEntry(ctx, job, op, src, target, overwrite); err != nil {
+			return err
+		}
+		if op == "copy" {
+			chargeFile(target, job.Username)
+		} else {
+			if err := quotaManager.Move(src, target); err != nil {
+				log.Printf("Failed to move quota records for %s: %v", src, err)
+			}
+			if err := aclManager.Move(src, target); err != nil {
+				log.Printf("Failed to move ACLs below %s: %v", src, err)
+			}
+		}
+		job.AddResult(target)
+	}
+	return nil
+}
+
+// transferEntry moves or copies src to target. The data is first placed
+// under a hidden temporary name beside target and renamed into place when
+// complete, so a cancelled or failed job never leaves a partial target.
+func transferEntry(ctx context.Context, job *Job, op, src, target string, overwrite bool) error {
+	tmp, err := tempSibling(target, "part")
+	if err != nil {
+		return err
+	}
+
+	copied := true
+	if op == "move" {
+		err := os.Rename(src, tmp)
+		switch {
+		case err == nil:
+			copied = false
+			files, bytes, _ := measureTree(tmp)
+			job.StartFile(src)
+			job.Advance(bytes)
+			for i := 0; i < files; i++ {
+				job.FinishFile()
+			}
+		case !errors.Is(err, syscall.EXDEV):
+			return err
+		}
+	}
+
+	if copied {
+		if err := copyTree(ctx, job, src, tmp); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+	}
+
+	if err := replaceWith(tmp, target, overwrite, job.Username); err != nil {
+		if copied {
+			os.RemoveAll(tmp)
+		} else {
+			// Put the source back where it was
+			os.Rename(tmp, src)
+		}
+		return err
+	}
+
+	if op == "move" && copied {
+		return os.RemoveAll(src)
+	}
+	return nil
+}
+
+// replaceWith renames from to target. An existing target is only replaced
+// when overwrite is set. A file replaced by a file is kept as a version on
+// behalf of username where versioning is on; anything else is sent to the
+// trash first and put back if the rename fails.
+func replaceWith(from, target string, overwrite bool, username string) error {
+	existing, err := os.Lstat(target)
+	if err != nil {
+		return os.Rename(from, target)
+	}
+	if !overwrite {
+		return ErrDestinationExists
+	}
+
+	if info, err := os.Lstat(from); err == nil && !info.IsDir() && existing.Mode().IsRegular() && versionManager.Enabled() {
+		if err := versionManager.Snapshot(target, username); err != nil {
+			return err
+		}
+		return os.Rename(from, target)
+	}
+
+	replaced, err := trashManager.trash(target, username)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(from, target); err != nil {
+		trashManager.putBack(replaced, target)
+		return err
+	}
+	return nil
+}
+
+// copyTree recursively copies src to dst, which must not exist, keeping
+// permissions and modification times. Symlinks are copied as links.
+func copyTree(ctx context.Context, job *Job, src, dst string) error {
+	type dirTime struct {
+		path    string
+		modTime time.Time
+	}
+	var dirs []dirTime
+
+	err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		out := filepath.Join(dst, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case info.IsDir():
+			if err := os.Mkdir(out, info.Mode().Perm()); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirTime{out, info.ModTime()})
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, out); err != nil {
+				return err
+			}
+			job.FinishFile()
+		case info.Mode().IsRegular():
+			job.StartFile(p)
+			if err := copyFile(ctx, job, p, out, info); err != nil {
+				return err
+			}
+			job.FinishFile()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Directory times change as entries are added, so set them last
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Chtimes(dirs[i].path, dirs[i].modTime, dirs[i].modTime)
+	}
+	return nil
+}
+
+func copyFile(ctx context.Context, job *Job, src, dst string, info fs.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(&progressWriter{ctx: ctx, job: job, w: out}, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// progressWriter reports copied bytes to a job and stops when it is cancelled
+type progressWriter struct {
+	ctx context.Context
+	job *Job
+	w   io.Writer
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	if err := pw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := pw.w.Write(p)
+	pw.job.Advance(int64(n))
+	return n, err
+}
+
+// measureTree counts the files below root and their total size
+func measureTree(root string) (files int, bytes int64, err error) {
+	err = filepath.WalkDir(root, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files++
+		if info.Mode().IsRegular() {
+			bytes += info.Size()
+		}
+		return nil
+	})
+	return files, bytes, err
+}
+
+// tempSibling returns an unused hidden name in the same folder as path
+func tempSibling(path, suffix string) (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+"."+token[:8]+"."+suffix), nil
+}
+
+// availableName returns path, or path numbered "name (2).ext" and upwards
+// until it does not exist
+func availableName(path string) string {
+	dir, name := filepath.Split(path)
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+
+	candidate := path
+	for i := 2; ; i++ {
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+		candidate = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", stem, i, ext))
+	}
+}
+
+// RenameFile renames a file or folder in place
+func RenameFile(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	var req RenameRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Temporary names would hide the entry from listings and search
+	if req.Name != filepath.Base(req.Name) || req.Name == "." || req.Name == ".." || isTemporaryName(req.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid name"})
+		return
+	}
+
+	src, ok := resolveRequestEntry(c, req.Path)
+	if !ok {
+		return
+	}
+	if _, err := os.Lstat(src); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if storage.IsRoot(src) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot rename a storage volume"})
+		return
+	}
+	if !requireTreeAccess(c, src, ACLDelete) || !requireAccess(c, filepath.Dir(src), ACLWrite) {
+		return
+	}
+
+	// Resolving the target refuses the reserved folders at a volume's top
+	target, ok := resolveRequestEntry(c, filepath.Join(filepath.Dir(src), req.Name))
+	if !ok {
+		return
+	}
+	overwrite := false
+	// A case-only rename on a case-insensitive filesystem finds the source
+	// itself at the target
+	if info, err := os.Lstat(target); err == nil && target != src && !sameFile(src, info) {
+		switch req.Conflict {
+		case ConflictOverwrite:
+			if !requireTreeAccess(c, target, ACLDelete) {
+				return
+			}
+			overwrite = true
+		case ConflictRename:
+			target = availableName(target)
+		default:
+			c.JSON(http.StatusConflict, gin.H{"error": "Destination already exists", "conflicts": []string{target}})
+			return
+		}
+	}
+
+	var err error
+	if overwrite {
+		err = replaceWith(src, target, true, user.Username)
+	} else {
+		err = os.Rename(src, target)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot rename file"})
+		return
+	}
+	if err := quotaManager.Move(src, target); err != nil {
+		log.Printf("Failed to move quota records for %s: %v", src, err)
+	}
+	if err := aclManager.Move(src, target); err != nil {
+		log.Printf("Failed to move ACLs below %s: %v", src, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "File renamed successfully",
+		"path":    target,
+	})
+}
+
+func sameFile(path string, info fs.FileInfo) bool {
+	other, err := os.Lstat(path)
+	return err == nil && os.SameFile(other, info)
+}
@@ -0,0 +1,495 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/shirou/gopsutil/v3/disk"
+	bolt "go.etcd.io/bbolt"
+)
+
+// trashDirName is the hidden folder at the top of each volume that holds
+// deleted items. It is not reachable through the file API.
+const trashDirName = ".nas-trash"
+
+var ErrTrashItemNotFound = errors.New("trash item not found")
+
+var trashBucket = []byte("trash")
+
+// TrashItem is a deleted file or folder waiting in its volume's trash
+type TrashItem struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	OriginalPath string    `json:"originalPath"`
+	Volume       string    `json:"volume"`
+	Size         int64     `json:"size"`
+	IsDir        bool      `json:"isDir"`
+	DeletedBy    string    `json:"deletedBy"`
+	DeletedAt    time.Time `json:"deletedAt"`
+}
+
+// TrashPolicy controls when items are purged automatically
+type TrashPolicy struct {
+	// MaxAge purges items deleted longer ago than this; zero keeps them
+	MaxAge time.Duration
+	// MaxUsage purges the oldest items while a volume is fuller than this
+	// percentage; zero disables the check
+	MaxUsage float64
+}
+
+type RestoreRequest struct {
+	Conflict string `json:"conflict" binding:"omitempty,oneof=fail overwrite rename"`
+}
+
+// TrashManager moves deleted items into per-volume trash folders and
+// records where they came from
+type TrashManager struct {
+	// mu serializes purges so the reaper and handlers do not race
+	mu     sync.Mutex
+	db     *bolt.DB
+	policy TrashPolicy
+}
+
+var trashManager *TrashManager
+
+// SetTrashManager configures the recycle bin used by DeleteFile
+func SetTrashManager(manager *TrashManager) {
+	trashManager = manager
+}
+
+// NewTrashManager creates the trash bucket if needed
+func NewTrashManager(db *bolt.DB, policy TrashPolicy) (*TrashManager, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(trashBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &TrashManager{db: db, policy: policy}, nil
+}
+
+// Trash moves path, which must be canonical, into its volume's trash
+func (m *TrashManager) Trash(path string, user *User) (*TrashItem, error) {
+	return m.trash(path, user.Username)
+}
+
+func (m *TrashManager) trash(path, username string) (*TrashItem, error) {
+	_, root, err := storage.contain(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	_, size, err := measureTree(path)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	item := &TrashItem{
+		ID:           id[:16],
+		Name:         filepath.Base(path),
+		OriginalPath: path,
+		Volume:       root.Path,
+		Size:         size,
+		IsDir:        info.IsDir(),
+		DeletedBy:    username,
+		DeletedAt:    time.Now(),
+	}
+
+	dir := filepath.Join(root.Path, trashDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := transferEntry(context.Background(), &Job{}, "move", path, filepath.Join(dir, item.ID), false); err != nil {
+		return nil, err
+	}
+
+	if err := m.put(item); err != nil {
+		// Without a record the item could never be restored, so undo
+		transferEntry(context.Background(), &Job{}, "move", filepath.Join(dir, item.ID), path, false)
+		return nil, err
+	}
+
+	// Trashed items still take up space, so they stay charged to their
+	// owners until purged
+	if err := quotaManager.Move(path, item.dataPath()); err != nil {
+		log.Printf("Failed to move quota records for %s: %v", path, err)
+	}
+	// ACLs come back with the item if it is restored
+	if err := aclManager.Move(path, item.dataPath()); err != nil {
+		log.Printf("Failed to move ACLs below %s: %v", path, err)
+	}
+	return item, nil
+}
+
+// List returns trashed items, newest first, optionally for one volume
+func (m *TrashManager) List(volume string) ([]TrashItem, error) {
+	items := []TrashItem{}
+	err := m.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(trashBucket).ForEach(func(_, v []byte) error {
+			var item TrashItem
+			if err := json.Unmarshal(v, &item); err != nil {
+				return err
+			}
+			if volume == "" || item.Volume == volume {
+				items = append(items, item)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].DeletedAt.After(items[j].DeletedAt) })
+	return items, nil
+}
+
+// Get returns a single trashed item
+func (m *TrashManager) Get(id string) (*TrashItem, error) {
+	var item TrashItem
+	err := m.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(trashBucket).Get([]byte(id))
+		if data == nil {
+			return ErrTrashItemNotFound
+		}
+		return json.Unmarshal(data, &item)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// Restore moves an item back to its original location, recreating missing
+// parent folders, and returns where it ended up. An entry it overwrites is
+// trashed in turn on behalf of username.
+func (m *TrashManager) Restore(id, conflict, username string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, err := m.Get(id)
+	if err != nil {
+		return "", err
+	}
+
+	// The original location may have become a link elsewhere since
+	target, _, err := storage.Resolve(item.OriginalPath)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+
+	overwrite := false
+	if _, err := os.Lstat(target); err == nil {
+		switch conflict {
+		case ConflictOverwrite:
+			overwrite = true
+		case ConflictRename:
+			target = availableName(target)
+		default:
+			return "", ErrDestinationExists
+		}
+	}
+
+	job := &Job{Username: username}
+	if err := transferEntry(context.Background(), job, "move", item.dataPath(), target, overwrite); err != nil {
+		return "", err
+	}
+	return target, m.restored(item, target)
+}
+
+// putBack returns an item trashed to make way for target, when replacing
+// target failed
+func (m *TrashManager) putBack(item *TrashItem, target string) {
+	err := transferEntry(context.Background(), &Job{}, "move", item.dataPath(), target, false)
+	if err == nil {
+		err = m.restored(item, target)
+	}
+	if err != nil {
+		log.Printf("Failed to put back %s from the trash: %v", target, err)
+	}
+}
+
+// restored moves the records of an item that is back at target out of the
+// trash
+func (m *TrashManager) restored(item *TrashItem, target string) error {
+	if err := quotaManager.Move(item.dataPath(), target); err != nil {
+		log.Printf("Failed to move quota records for %s: %v", target, err)
+	}
+	if err := aclManager.Move(item.dataPath(), target); err != nil {
+		log.Printf("Failed to move ACLs below %s: %v", target, err)
+	}
+	return m.delete(item.ID)
+}
+
+// Purge permanently deletes a trashed item
+func (m *TrashManager) Purge(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, err := m.Get(id)
+	if err != nil {
+		return err
+	}
+	return m.purge(item)
+}
+
+// Empty permanently deletes everything in the trash, optionally for one
+// volume, and returns how many items were removed. When match is set only
+// the items it accepts are deleted.
+func (m *TrashManager) Empty(volume string, match func(*TrashItem) bool) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	items, err := m.List(volume)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for i := range items {
+		if match != nil && !match(&items[i]) {
+			continue
+		}
+		if err := m.purge(&items[i]); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Enforce applies the retention policy: items past MaxAge are purged, then
+// the oldest items on volumes above MaxUsage until they drop below it
+func (m *TrashManager) Enforce() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	items, err := m.List("")
+	if err != nil {
+		log.Printf("Failed to list trash: %v", err)
+		return
+	}
+
+	// Oldest first
+	sort.Slice(items, func(i, j int) bool { return items[i].DeletedAt.Before(items[j].DeletedAt) })
+
+	kept := items[:0]
+	for i := range items {
+		if m.policy.MaxAge > 0 && time.Since(items[i].DeletedAt) > m.policy.MaxAge {
+			if err := m.purge(&items[i]); err != nil {
+				log.Printf("Failed to purge %s from trash: %v", items[i].OriginalPath, err)
+			}
+			continue
+		}
+		kept = append(kept, items[i])
+	}
+
+	if m.policy.MaxUsage <= 0 {
+		return
+	}
+	for _, root := range storage.Roots() {
+		for i := range kept {
+			if kept[i].Volume != root.Path {
+				continue
+			}
+			usage, err := disk.Usage(root.Path)
+			if err != nil || usage.UsedPercent <= m.policy.MaxUsage {
+				break
+			}
+			if err := m.purge(&kept[i]); err != nil {
+				log.Printf("Failed to purge %s from trash: %v", kept[i].OriginalPath, err)
+			}
+		}
+	}
+}
+
+// StartReaper enforces the retention policy every interval until stop is
+// called
+func (m *TrashManager) StartReaper(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				m.Enforce()
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// purge deletes an item's data and record; the caller must hold m.mu
+func (m *TrashManager) purge(item *TrashItem) error {
+	if err := os.RemoveAll(item.dataPath()); err != nil {
+		return err
+	}
+	if err := quotaManager.Forget(item.dataPath()); err != nil {
+		return err
+	}
+	if err := aclManager.Forget(item.dataPath()); err != nil {
+		return err
+	}
+	return m.delete(item.ID)
+}
+
+func (m *TrashManager) put(item *TrashItem) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(trashBucket).Put([]byte(item.ID), data)
+	})
+}
+
+func (m *TrashManager) delete(id string) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(trashBucket).Delete([]byte(id))
+	})
+}
+
+func (item *TrashItem) dataPath() string {
+	return filepath.Join(item.Volume, trashDirName, item.ID)
+}
+
+// GetTrash lists deleted items, optionally for ?volume=. Items are only
+// listed to callers who may read where they were deleted from.
+func GetTrash(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	items, err := trashManager.List(c.Query("volume"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot read trash"})
+		return
+	}
+
+	visible := items[:0]
+	var totalSize int64
+	for _, item := range items {
+		if !aclManager.Allowed(user, item.OriginalPath, ACLRead) {
+			continue
+		}
+		visible = append(visible, item)
+		totalSize += item.Size
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": visible, "totalSize": totalSize})
+}
+
+// RestoreTrashItem moves an item back to where it was deleted from
+func RestoreTrashItem(c *gin.Context) {
+	var req RestoreRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	item, err := trashManager.Get(c.Param("id"))
+	if err != nil {
+		writeTrashError(c, err)
+		return
+	}
+	if !requireAccess(c, filepath.Dir(item.OriginalPath), ACLWrite) {
+		return
+	}
+	// Overwriting deletes what took the item's place
+	if req.Conflict == ConflictOverwrite {
+		if target, _, err := storage.Resolve(item.OriginalPath); err == nil {
+			if _, err := os.Lstat(target); err == nil && !requireTreeAccess(c, target, ACLDelete) {
+				return
+			}
+		}
+	}
+
+	path, err := trashManager.Restore(item.ID, req.Conflict, c.MustGet("user").(*User).Username)
+	if err != nil {
+		writeTrashError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Item restored successfully",
+		"path":    path,
+	})
+}
+
+// PurgeTrashItem permanently deletes one item from the trash
+func PurgeTrashItem(c *gin.Context) {
+	item, err := trashManager.Get(c.Param("id"))
+	if err != nil {
+		writeTrashError(c, err)
+		return
+	}
+	if !requireAccess(c, item.OriginalPath, ACLDelete) {
+		return
+	}
+
+	if err := trashManager.Purge(item.ID); err != nil {
+		writeTrashError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Item deleted permanently"})
+}
+
+// EmptyTrash permanently deletes everything in the trash the caller may
+// delete, optionally for ?volume=
+func EmptyTrash(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	count, err := trashManager.Empty(c.Query("volume"), func(item *TrashItem) bool {
+		return aclManager.Allowed(user, item.OriginalPath, ACLDelete)
+	})
+	if err != nil {
+		writeTrashError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Trash emptied successfully",
+		"count":   count,
+	})
+}
+
+func writeTrashError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrTrashItemNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found in trash"})
+	case errors.Is(err, ErrDestinationExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "Original location is occupied"})
+	case errors.Is(err, ErrOutsideStorage):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Original location is outside the storage volumes"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Trash operation failed"})
+	}
+}
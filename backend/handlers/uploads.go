@@ -0,0 +1,582 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+// tusVersion is the only tus protocol version spoken by the upload endpoints
+const tusVersion = "1.0.0"
+
+// tusExtensions lists the supported tus protocol extensions
+const tusExtensions = "creation,creation-with-upload,termination,checksum,expiration"
+
+// uploadTTL is how long an upload may sit idle before it is discarded
+const uploadTTL = 24 * time.Hour
+
+// statusChecksumMismatch is defined by the tus checksum extension
+const statusChecksumMismatch = 460
+
+var (
+	ErrUploadNotFound       = errors.New("upload not found")
+	ErrUploadOffsetMismatch = errors.New("upload offset mismatch")
+	ErrUploadLocked         = errors.New("upload is in use")
+	ErrChecksumMismatch     = errors.New("checksum mismatch")
+)
+
+var uploadsBucket = []byte("uploads")
+
+// checksumAlgorithms maps tus algorithm names to hash constructors
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// Upload is a resumable upload in progress. Data is written to a temporary
+// file under the upload directory and moved into Dir once Length bytes
+// have arrived.
+type Upload struct {
+	ID       string    `json:"id"`
+	UserID   int       `json:"userId"`
+	Username string    `json:"username"`
+	Filename string    `json:"filename"`
+	Dir      string    `json:"dir"`
+	Length   int64     `json:"length"`
+	Offset   int64     `json:"offset"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+}
+
+// uploadChecksum is a parsed Upload-Checksum header
+type uploadChecksum struct {
+	hash     hash.Hash
+	expected []byte
+}
+
+// UploadManager stores upload state in bolt and chunk data on disk
+type UploadManager struct {
+	db  *bolt.DB
+	dir string
+
+	mu sync.Mutex
+	// busy holds the IDs of uploads currently being written or removed
+	busy map[string]bool
+}
+
+var uploadManager *UploadManager
+
+// SetUploadManager configures the manager used for resumable uploads
+func SetUploadManager(manager *UploadManager) {
+	uploadManager = manager
+}
+
+// NewUploadManager keeps partial uploads in dir, which is created if needed
+func NewUploadManager(db *bolt.DB, dir string) (*UploadManager, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(uploadsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &UploadManager{db: db, dir: dir, busy: make(map[string]bool)}, nil
+}
+
+// Create registers a new upload of length bytes into dir/filename and
+// reserves quota for it until it is finished or discarded
+func (m *UploadManager) Create(user *User, dir, filename string, length int64) (*Upload, error) {
+	id, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	upload := &Upload{
+		ID:       id[:32],
+		UserID:   user.ID,
+		Username: user.Username,
+		Filename: filename,
+		Dir:      dir,
+		Length:   length,
+		Created:  now,
+		Expires:  now.Add(uploadTTL),
+	}
+
+	f, err := os.OpenFile(m.dataPath(upload.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	if _, err := quotaManager.Reserve(upload.ID, user.Username, filepath.Join(dir, filename), length); err != nil {
+		os.Remove(m.dataPath(upload.ID))
+		return nil, err
+	}
+	if err := m.put(upload); err != nil {
+		quotaManager.Release(upload.ID)
+		os.Remove(m.dataPath(upload.ID))
+		return nil, err
+	}
+	return upload, nil
+}
+
+// Get returns the upload with id if it belongs to userID
+func (m *UploadManager) Get(id string, userID int) (*Upload, error) {
+	var upload Upload
+	err := m.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(uploadsBucket).Get([]byte(id))
+		if data == nil {
+			return ErrUploadNotFound
+		}
+		return json.Unmarshal(data, &upload)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if upload.UserID != userID || time.Now().After(upload.Expires) {
+		return nil, ErrUploadNotFound
+	}
+	return &upload, nil
+}
+
+// Write appends body at offset. Without a checksum whatever arrives before
+// the connection drops is kept so the client can resume from there; with
+// one, the chunk is discarded unless it matches. Once the last byte has
+// been written the file is moved into place and the upload removed.
+func (m *UploadManager) Write(id string, userID int, offset int64, body io.Reader, checksum *uploadChecksum) (*Upload, error) {
+	if !m.acquire(id) {
+		return nil, ErrUploadLocked
+	}
+	defer m.release(id)
+
+	upload, err := m.Get(id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if offset != upload.Offset {
+		return upload, ErrUploadOffsetMismatch
+	}
+
+	f, err := os.OpenFile(m.dataPath(id), os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Drop anything past the recorded offset, e.g. from a crash mid-write
+	if err := f.Truncate(offset); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var w io.Writer = f
+	if checksum != nil {
+		w = io.MultiWriter(f, checksum.hash)
+	}
+	n, copyErr := io.Copy(w, io.LimitReader(body, upload.Length-offset))
+
+	if checksum != nil {
+		if copyErr == nil && !bytes.Equal(checksum.hash.Sum(nil), checksum.expected) {
+			copyErr = ErrChecksumMismatch
+		}
+		if copyErr != nil {
+			f.Truncate(offset)
+			return upload, copyErr
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+
+	upload.Offset += n
+	upload.Expires = time.Now().Add(uploadTTL)
+	if err := m.put(upload); err != nil {
+		return nil, err
+	}
+	if copyErr != nil {
+		return upload, copyErr
+	}
+
+	if upload.Offset == upload.Length {
+		f.Close()
+		if err := m.finish(upload); err != nil {
+			return nil, err
+		}
+	}
+	return upload, nil
+}
+
+// Terminate discards an upload and its data
+func (m *UploadManager) Terminate(id string, userID int) error {
+	if !m.acquire(id) {
+		return ErrUploadLocked
+	}
+	defer m.release(id)
+
+	if _, err := m.Get(id, userID); err != nil {
+		return err
+	}
+	return m.remove(id)
+}
+
+// Reap discards uploads that have been idle past their expiry
+func (m *UploadManager) Reap() {
+	now := time.Now()
+
+	var expired []string
+	m.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(uploadsBucket).ForEach(func(k, v []byte) error {
+			var upload Upload
+			if err := json.Unmarshal(v, &upload); err == nil && now.After(upload.Expires) {
+				expired = append(expired, string(k))
+			}
+			return nil
+		})
+	})
+
+	for _, id := range expired {
+		if !m.acquire(id) {
+			continue
+		}
+		if err := m.remove(id); err != nil {
+			log.Printf("Failed to discard expired upload %s: %v", id, err)
+		}
+		m.release(id)
+	}
+}
+
+// StartReaper discards expired uploads every interval until stop is called
+func (m *UploadManager) StartReaper(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				m.Reap()
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// finish moves a complete upload into its target directory. The target,
+// access to it and the quota are checked again since the tree, its ACLs
+// and the uploader's other files may have changed since creation.
+func (m *UploadManager) finish(upload *Upload) error {
+	dest, _, err := storage.Resolve(filepath.Join(upload.Dir, upload.Filename))
+	if err != nil {
+		return err
+	}
+	user, err := userStore.GetUserByID(upload.UserID)
+	if err != nil {
+		return err
+	}
+	if !aclManager.Allowed(user, filepath.Dir(dest), ACLWrite) {
+		return os.ErrPermission
+	}
+	if _, err := os.Lstat(dest); err == nil && !aclManager.AllowedTree(user, dest, ACLDelete) {
+		return os.ErrPermission
+	}
+	if _, err := quotaManager.Reserve(upload.ID, upload.Username, dest, upload.Length); err != nil {
+		return err
+	}
+	if err := os.Chmod(m.dataPath(upload.ID), 0644); err != nil {
+		return err
+	}
+	if err := versionManager.Snapshot(dest, upload.Username); err != nil {
+		return err
+	}
+	if err := renameOrCopy(m.dataPath(upload.ID), dest); err != nil {
+		return err
+	}
+	chargeFile(dest, upload.Username)
+	return m.remove(upload.ID)
+}
+
+func (m *UploadManager) remove(id string) error {
+	quotaManager.Release(id)
+	if err := os.Remove(m.dataPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(uploadsBucket).Delete([]byte(id))
+	})
+}
+
+func (m *UploadManager) put(upload *Upload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(uploadsBucket).Put([]byte(upload.ID), data)
+	})
+}
+
+func (m *UploadManager) dataPath(id string) string {
+	return filepath.Join(m.dir, id)
+}
+
+func (m *UploadManager) acquire(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.busy[id] {
+		return false
+	}
+	m.busy[id] = true
+	return true
+}
+
+func (m *UploadManager) release(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.busy, id)
+}
+
+// parseUploadMetadata decodes an Upload-Metadata header: comma-separated
+// keys, each optionally followed by a space and a base64 value
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// parseUploadChecksum decodes an Upload-Checksum header of the form
+// "<algorithm> <base64 digest>"
+func parseUploadChecksum(header string) (*uploadChecksum, error) {
+	algorithm, encoded, found := strings.Cut(header, " ")
+	newHash, supported := checksumAlgorithms[algorithm]
+	if !found || !supported {
+		return nil, errors.New("unsupported checksum algorithm")
+	}
+	expected, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return &uploadChecksum{hash: newHash(), expected: expected}, nil
+}
+
+// TusResumable rejects requests for other protocol versions and marks every
+// response with the version spoken. OPTIONS is exempt so that clients can
+// discover the server's capabilities.
+func TusResumable() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Tus-Resumable", tusVersion)
+		if c.Request.Method != http.MethodOptions && c.GetHeader("Tus-Resumable") != tusVersion {
+			c.Header("Tus-Version", tusVersion)
+			c.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{"error": "Unsupported tus version"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// TusOptions advertises the supported protocol version and extensions
+func TusOptions(c *gin.Context) {
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	c.Header("Tus-Checksum-Algorithm", "md5,sha1,sha256")
+	c.Status(http.StatusNoContent)
+}
+
+// CreateUpload starts a resumable upload. Upload-Metadata must carry the
+// filename and may carry the target path, defaulting to the first volume.
+func CreateUpload(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Length"})
+		return
+	}
+
+	metadata, err := parseUploadMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Metadata"})
+		return
+	}
+
+	filename := metadata["filename"]
+	if filename == "" || filename != filepath.Base(filename) || filename == "." || filename == ".." {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid filename"})
+		return
+	}
+
+	path := metadata["path"]
+	if path == "" {
+		path = storage.Default()
+	}
+	dir, ok := resolveRequestPath(c, path)
+	if !ok {
+		return
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Target directory does not exist"})
+		return
+	}
+	target, ok := resolveRequestPath(c, filepath.Join(dir, filename))
+	if !ok {
+		return
+	}
+	if !requireAccess(c, filepath.Dir(target), ACLWrite) || !requireReplaceAccess(c, target) {
+		return
+	}
+	if !checkQuota(c, user.Username, target, length) {
+		return
+	}
+
+	upload, err := uploadManager.Create(user, dir, filename, length)
+	var exceeded *QuotaExceededError
+	if errors.As(err, &exceeded) {
+		writeQuotaExceeded(c, exceeded)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot create upload"})
+		return
+	}
+
+	c.Header("Location", strings.TrimSuffix(c.Request.URL.Path, "/")+"/"+upload.ID)
+	c.Header("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+
+	// creation-with-upload: the request body may carry the first chunk,
+	// and an empty upload is complete straight away
+	if length == 0 || c.GetHeader("Content-Type") == "application/offset+octet-stream" {
+		upload, err = uploadManager.Write(upload.ID, user.ID, 0, c.Request.Body, nil)
+		if err != nil {
+			writeUploadError(c, err)
+			return
+		}
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Status(http.StatusCreated)
+}
+
+// HeadUpload reports how much of an upload the server has received
+func HeadUpload(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	upload, err := uploadManager.Get(c.Param("id"), user.ID)
+	if err != nil {
+		writeUploadError(c, err)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Header("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusOK)
+}
+
+// PatchUpload appends a chunk at Upload-Offset
+func PatchUpload(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	if c.GetHeader("Content-Type") != "application/offset+octet-stream" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be application/offset+octet-stream"})
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Offset"})
+		return
+	}
+
+	var checksum *uploadChecksum
+	if header := c.GetHeader("Upload-Checksum"); header != "" {
+		if checksum, err = parseUploadChecksum(header); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Checksum"})
+			return
+		}
+	}
+
+	upload, err := uploadManager.Write(c.Param("id"), user.ID, offset, c.Request.Body, checksum)
+	if err != nil {
+		writeUploadError(c, err)
+		return
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusNoContent)
+}
+
+// DeleteUpload terminates an upload and discards the data received so far
+func DeleteUpload(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	if err := uploadManager.Terminate(c.Param("id"), user.ID); err != nil {
+		writeUploadError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func writeUploadError(c *gin.Context, err error) {
+	var exceeded *QuotaExceededError
+	switch {
+	case errors.Is(err, ErrUploadNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+	case errors.Is(err, ErrUploadOffsetMismatch):
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload-Offset does not match the current offset"})
+	case errors.Is(err, ErrUploadLocked):
+		c.JSON(http.StatusLocked, gin.H{"error": "Upload is in use by another request"})
+	case errors.Is(err, ErrChecksumMismatch):
+		c.JSON(statusChecksumMismatch, gin.H{"error": "Checksum mismatch"})
+	case errors.Is(err, ErrOutsideStorage):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Path is outside the storage volumes"})
+	case errors.Is(err, os.ErrPermission):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+	case errors.As(err, &exceeded):
+		writeQuotaExceeded(c, exceeded)
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot write upload"})
+	}
+}
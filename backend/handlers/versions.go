@@ -0,0 +1,450 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+// versionsDirName is the hidden folder at the top of each volume that
+// holds earlier versions of overwritten files
+const versionsDirName = ".nas-versions"
+
+var ErrVersionNotFound = errors.New("version not found")
+
+var versionsBucket = []byte("versions")
+
+// FileVersion is an earlier state of a file, kept when it was overwritten
+type FileVersion struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"`
+	Volume  string    `json:"volume"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	// Created is when the version was replaced, and CreatedBy who replaced it
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"createdBy"`
+}
+
+// VersionPolicy controls how much history is kept
+type VersionPolicy struct {
+	// MaxVersions per file; zero turns versioning off
+	MaxVersions int
+	// MaxAge purges versions replaced longer ago than this; zero keeps them
+	MaxAge time.Duration
+}
+
+// VersionManager keeps prior contents of files in per-volume version
+// folders before they are replaced
+type VersionManager struct {
+	// mu serializes pruning so the reaper and handlers do not race
+	mu     sync.Mutex
+	db     *bolt.DB
+	policy VersionPolicy
+}
+
+var versionManager *VersionManager
+
+// SetVersionManager configures the version store used when files are
+// overwritten
+func SetVersionManager(manager *VersionManager) {
+	versionManager = manager
+}
+
+// NewVersionManager creates the versions bucket if needed
+func NewVersionManager(db *bolt.DB, policy VersionPolicy) (*VersionManager, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(versionsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &VersionManager{db: db, policy: policy}, nil
+}
+
+// Snapshot keeps the current contents of path, which must be canonical,
+// as a version before it is replaced. Paths that do not exist or are not
+// regular files are ignored.
+func (m *VersionManager) Snapshot(path, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.snapshot(path, username)
+}
+
+// Enabled reports whether replaced files are kept as versions
+func (m *VersionManager) Enabled() bool {
+	return m.policy.MaxVersions > 0
+}
+
+// List returns the versions of path, newest first
+func (m *VersionManager) List(path string) ([]FileVersion, error) {
+	return m.listWhere(func(v *FileVersion) bool { return v.Path == path })
+}
+
+// Get returns a single version
+func (m *VersionManager) Get(id string) (*FileVersion, error) {
+	var version FileVersion
+	err := m.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(versionsBucket).Get([]byte(id))
+		if data == nil {
+			return ErrVersionNotFound
+		}
+		return json.Unmarshal(data, &version)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+// Restore makes a version the current contents of its file again. What
+// was current becomes a version itself, so a restore can be undone.
+func (m *VersionManager) Restore(id, username string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	version, err := m.Get(id)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(version.dataPath())
+	if err != nil {
+		return "", err
+	}
+
+	// The file may have become a link elsewhere since
+	target, _, err := storage.Resolve(version.Path)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+
+	tmp, err := tempSibling(target, "part")
+	if err != nil {
+		return "", err
+	}
+	if err := copyFile(context.Background(), &Job{}, version.dataPath(), tmp, info); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := m.snapshot(target, username); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	chargeFile(target, username)
+	return target, nil
+}
+
+// Delete permanently removes a version
+func (m *VersionManager) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	version, err := m.Get(id)
+	if err != nil {
+		return err
+	}
+	return m.purge(version)
+}
+
+// Enforce purges versions older than the policy's MaxAge
+func (m *VersionManager) Enforce() {
+	if m.policy.MaxAge <= 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := time.Now().Add(-m.policy.MaxAge)
+	versions, err := m.listWhere(func(v *FileVersion) bool { return v.Created.Before(cutoff) })
+	if err != nil {
+		log.Printf("Failed to list file versions: %v", err)
+		return
+	}
+	for i := range versions {
+		if err := m.purge(&versions[i]); err != nil {
+			log.Printf("Failed to purge version of %s: %v", versions[i].Path, err)
+		}
+	}
+}
+
+// StartReaper enforces the retention policy every interval until stop is
+// called
+func (m *VersionManager) StartReaper(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				m.Enforce()
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// snapshot does the work of Snapshot; the caller must hold m.mu
+func (m *VersionManager) snapshot(path, username string) error {
+	if m.policy.MaxVersions <= 0 {
+		return nil
+	}
+
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	_, root, err := storage.contain(path)
+	if err != nil {
+		return err
+	}
+	id, err := generateToken()
+	if err != nil {
+		return err
+	}
+
+	version := &FileVersion{
+		ID:        id[:16],
+		Path:      path,
+		Volume:    root.Path,
+		Size:      info.Size(),
+		ModTime:   info.ModTime(),
+		Created:   time.Now(),
+		CreatedBy: username,
+	}
+
+	if err := os.MkdirAll(filepath.Join(root.Path, versionsDirName), 0700); err != nil {
+		return err
+	}
+	// The data is copied rather than linked since Samba and local programs
+	// rewrite files in place, which would change the version as well
+	if err := cloneFile(path, version.dataPath(), info); err != nil {
+		os.Remove(version.dataPath())
+		return err
+	}
+
+	if err := m.put(version); err != nil {
+		os.Remove(version.dataPath())
+		return err
+	}
+	return m.prune(path)
+}
+
+// cloneFile copies src to dst. Copying between files lets the kernel use
+// copy_file_range, which shares the data on filesystems with reflinks such
+// as Btrfs and XFS until either copy changes.
+func cloneFile(src, dst string, info fs.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = out.ReadFrom(in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// prune drops the oldest versions of path beyond MaxVersions; the caller
+// must hold m.mu
+func (m *VersionManager) prune(path string) error {
+	versions, err := m.List(path)
+	if err != nil {
+		return err
+	}
+	for i := m.policy.MaxVersions; i < len(versions); i++ {
+		if err := m.purge(&versions[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *VersionManager) listWhere(match func(*FileVersion) bool) ([]FileVersion, error) {
+	versions := []FileVersion{}
+	err := m.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(versionsBucket).ForEach(func(_, v []byte) error {
+			var version FileVersion
+			if err := json.Unmarshal(v, &version); err != nil {
+				return err
+			}
+			if match(&version) {
+				versions = append(versions, version)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Created.After(versions[j].Created) })
+	return versions, nil
+}
+
+func (m *VersionManager) purge(version *FileVersion) error {
+	if err := os.Remove(version.dataPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(versionsBucket).Delete([]byte(version.ID))
+	})
+}
+
+func (m *VersionManager) put(version *FileVersion) error {
+	data, err := json.Marshal(version)
+	if err != nil {
+		return err
+	}
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(versionsBucket).Put([]byte(version.ID), data)
+	})
+}
+
+func (version *FileVersion) dataPath() string {
+	return filepath.Join(version.Volume, versionsDirName, version.ID)
+}
+
+// GetVersions lists the earlier versions of the file at ?path=
+func GetVersions(c *gin.Context) {
+	filePath := c.Query("path")
+	if filePath == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File path required"})
+		return
+	}
+
+	cleanPath, ok := resolveRequestPath(c, filePath)
+	if !ok {
+		return
+	}
+	if !requireAccess(c, cleanPath, ACLRead) {
+		return
+	}
+
+	versions, err := versionManager.List(cleanPath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot load versions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"path":     cleanPath,
+		"versions": versions,
+	})
+}
+
+// DownloadVersion serves the contents of a version under its file's name
+func DownloadVersion(c *gin.Context) {
+	version, ok := accessibleVersion(c, ACLRead)
+	if !ok {
+		return
+	}
+
+	serveFile(c, version.dataPath(), filepath.Base(version.Path), c.DefaultQuery("disposition", "attachment"))
+}
+
+// RestoreVersion makes a version the current contents of its file
+func RestoreVersion(c *gin.Context) {
+	user := c.MustGet("user").(*User)
+
+	version, ok := accessibleVersion(c, ACLWrite)
+	if !ok || !requireReplaceAccess(c, version.Path) {
+		return
+	}
+	if !checkQuota(c, user.Username, version.Path, version.Size) {
+		return
+	}
+
+	path, err := versionManager.Restore(version.ID, user.Username)
+	if err != nil {
+		writeVersionError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Version restored successfully",
+		"path":    path,
+	})
+}
+
+// DeleteVersion permanently removes a version
+func DeleteVersion(c *gin.Context) {
+	version, ok := accessibleVersion(c, ACLDelete)
+	if !ok {
+		return
+	}
+
+	if err := versionManager.Delete(version.ID); err != nil {
+		writeVersionError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Version deleted successfully"})
+}
+
+// accessibleVersion loads :id and checks its file is one the caller may
+// reach through the file API with perm
+func accessibleVersion(c *gin.Context, perm string) (*FileVersion, bool) {
+	version, err := versionManager.Get(c.Param("id"))
+	if err != nil {
+		writeVersionError(c, err)
+		return nil, false
+	}
+	cleanPath, ok := resolveRequestPath(c, version.Path)
+	if !ok || !requireAccess(c, cleanPath, perm) {
+		return nil, false
+	}
+	return version, true
+}
+
+func writeVersionError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrVersionNotFound), os.IsNotExist(err):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+	case errors.Is(err, ErrOutsideStorage):
+		c.JSON(http.StatusForbidden, gin.H{"error": "File is outside the storage volumes"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Version operation failed"})
+	}
+}
@@ -0,0 +1,546 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/webdav"
+)
+
+// davRealm is announced to clients so that they prompt for credentials
+const davRealm = `Basic realm="NAS OS", charset="UTF-8"`
+
+// davReadMethods only need files:read; every other method changes data
+var davReadMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	"PROPFIND":         true,
+}
+
+// DAVMethods are the HTTP methods the WebDAV handler must be routed for
+var DAVMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete,
+	"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK",
+}
+
+// DAVBasicAuth lets WebDAV clients, which only speak Basic auth, sign in
+// with an API token or session token as the password. It must run before
+// AuthMiddleware, which does the actual validation.
+func DAVBasicAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if username, password, ok := c.Request.BasicAuth(); ok {
+			c.Request.Header.Set("Authorization", "Bearer "+password)
+			c.Set("davUsername", username)
+		}
+		// Cleared again by WebDAVHandler once the caller is authenticated
+		c.Header("WWW-Authenticate", davRealm)
+		c.Next()
+	}
+}
+
+// WebDAVHandler serves the storage volumes over WebDAV below prefix. Each
+// volume appears as a top-level collection named after it. Deletions go to
+// the trash as they do through the file API.
+func WebDAVHandler(prefix string) gin.HandlerFunc {
+	locks := webdav.NewMemLS()
+
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*User)
+
+		if username := c.GetString("davUsername"); username != "" && normalizeUsername(username) != normalizeUsername(user.Username) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Token does not belong to this user"})
+			return
+		}
+		c.Writer.Header().Del("WWW-Authenticate")
+
+		perm := PermFilesWrite
+		if davReadMethods[c.Request.Method] {
+			perm = PermFilesRead
+		}
+		if !hasPermission(c, perm) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+			return
+		}
+
+		reservation, err := generateToken()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot check storage quota"})
+			return
+		}
+		fileSystem := &davFileSystem{user: user, reservation: reservation}
+		defer quotaManager.Release(reservation)
+		if !fileSystem.checkQuota(c, prefix) {
+			return
+		}
+
+		handler := &webdav.Handler{
+			Prefix:     prefix,
+			FileSystem: fileSystem,
+			LockSystem: locks,
+			Logger: func(r *http.Request, err error) {
+				if err != nil && !os.IsNotExist(err) && !os.IsPermission(err) {
+					log.Printf("WebDAV %s %s failed: %v", r.Method, r.URL.Path, err)
+				}
+			},
+		}
+		handler.ServeHTTP(&davResponseWriter{ResponseWriter: c.Writer, c: c, fileSystem: fileSystem}, c.Request)
+	}
+}
+
+// davResponseWriter turns the 405 the WebDAV handler reports for any failed
+// write into a 507 when the write went over a quota
+type davResponseWriter struct {
+	http.ResponseWriter
+	c          *gin.Context
+	fileSystem *davFileSystem
+	replaced   bool
+}
+
+func (w *davResponseWriter) WriteHeader(status int) {
+	if status < http.StatusBadRequest || w.fileSystem.exceeded == nil {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.replaced = true
+	writeQuotaExceeded(w.c, w.fileSystem.exceeded)
+}
+
+func (w *davResponseWriter) Write(p []byte) (int, error) {
+	if w.replaced {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// davFileSystem maps WebDAV paths of the form /<volume>/<path> onto the
+// storage volumes, applying the same jail and folder ACLs as the file API
+type davFileSystem struct {
+	user *User
+	// reservation is the key the request's writes reserve quota under and
+	// reserved the bytes currently held by it
+	reservation string
+	reserved    int64
+	// exceeded is set once a write is refused for going over a quota
+	exceeded *QuotaExceededError
+}
+
+// checkQuota refuses requests that add data the caller's quota cannot
+// take before any of it is written, and reserves it for the request. PUT
+// bodies of unknown length are limited as they are written instead.
+func (d *davFileSystem) checkQuota(c *gin.Context, prefix string) bool {
+	method := c.Request.Method
+	if method == http.MethodPut {
+		if c.Request.ContentLength <= 0 {
+			return true
+		}
+		if p, err := d.resolve(strings.TrimPrefix(c.Request.URL.Path, prefix), true); err == nil && p != "" {
+			return d.reserve(c, p, c.Request.ContentLength)
+		}
+		return true
+	}
+	if method != "COPY" && method != "MOVE" {
+		return true
+	}
+
+	// Problems with either path are left to the WebDAV handler to report
+	src, err := d.resolve(strings.TrimPrefix(c.Request.URL.Path, prefix), false)
+	if err != nil || src == "" {
+		return true
+	}
+	dest, err := url.Parse(c.GetHeader("Destination"))
+	if err != nil {
+		return true
+	}
+	dst, err := d.resolve(strings.TrimPrefix(dest.Path, prefix), true)
+	if err != nil || dst == "" {
+		return true
+	}
+	// Moves within a volume keep their owner's usage unchanged
+	if method == "MOVE" && volumeOf(src) == volumeOf(dst) {
+		return true
+	}
+	_, size, err := measureTree(src)
+	if err != nil {
+		return true
+	}
+	return d.reserve(c, dst, size)
+}
+
+// reserve holds size bytes at p for the request, replying like checkQuota
+func (d *davFileSystem) reserve(c *gin.Context, p string, size int64) bool {
+	soft, err := quotaManager.Reserve(d.reservation, d.user.Username, p, size)
+	if err == nil {
+		d.reserved = size
+	}
+	return quotaAllows(c, soft, err)
+}
+
+// allow fails with os.ErrPermission unless the user holds perm at p
+func (d *davFileSystem) allow(p, perm string) error {
+	if !aclManager.Allowed(d.user, p, perm) {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+// resolve returns the canonical path for name. The root of the namespace,
+// which lists the volumes, resolves to "". With follow unset, a symlink in
+// the final component is returned as itself.
+func (d *davFileSystem) resolve(name string, follow bool) (string, error) {
+	clean := path.Clean("/" + name)
+	if clean == "/" {
+		return "", nil
+	}
+
+	volume, rest, _ := strings.Cut(strings.TrimPrefix(clean, "/"), "/")
+	for _, root := range storage.Roots() {
+		if root.Name != volume {
+			continue
+		}
+		p := filepath.Join(root.Path, filepath.FromSlash(rest))
+		var resolved string
+		var err error
+		if follow {
+			resolved, _, err = storage.Resolve(p)
+		} else {
+			resolved, _, err = storage.ResolveEntry(p)
+		}
+		if err != nil {
+			return "", os.ErrPermission
+		}
+		return resolved, nil
+	}
+	return "", os.ErrNotExist
+}
+
+func (d *davFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	p, err := d.resolve(name, true)
+	if err != nil {
+		return err
+	}
+	if p == "" {
+		return os.ErrExist
+	}
+	if err := d.allow(filepath.Dir(p), ACLWrite); err != nil {
+		return err
+	}
+	return os.Mkdir(p, 0755)
+}
+
+func (d *davFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	p, err := d.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	if p == "" {
+		if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+			return nil, os.ErrPermission
+		}
+		return &davRootDir{}, nil
+	}
+
+	writing := flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0
+	if writing {
+		err = d.allow(filepath.Dir(p), ACLWrite)
+	} else {
+		err = d.allow(p, ACLRead)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Saving over a file writes to a hidden sibling first, which Close
+	// moves over the target, so a failed upload leaves the old file intact
+	target := p
+	if flag&os.O_TRUNC != 0 {
+		if info, err := os.Lstat(p); err == nil {
+			if info.IsDir() {
+				return nil, &fs.PathError{Op: "open", Path: p, Err: syscall.EISDIR}
+			}
+			// Replacing a file destroys it as much as deleting it does
+			if err := d.allow(p, ACLDelete); err != nil {
+				return nil, err
+			}
+		}
+		if p, err = tempSibling(target, "part"); err != nil {
+			return nil, err
+		}
+		flag |= os.O_CREATE | os.O_EXCL
+	}
+
+	f, err := os.OpenFile(p, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	file := &davFile{File: f, path: target, user: d.user}
+	if p != target {
+		file.part = p
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		file.owner = d.user.Username
+		file.fileSystem = d
+		if info, err := f.Stat(); err == nil {
+			file.size = info.Size()
+		}
+	}
+	return file, nil
+}
+
+// RemoveAll moves name to the trash. Volumes themselves cannot be removed.
+func (d *davFileSystem) RemoveAll(ctx context.Context, name string) error {
+	p, err := d.resolve(name, false)
+	if err != nil {
+		return err
+	}
+	if p == "" || storage.IsRoot(p) {
+		return os.ErrPermission
+	}
+	if _, err := os.Lstat(p); err != nil {
+		return err
+	}
+	if !aclManager.AllowedTree(d.user, p, ACLDelete) {
+		return os.ErrPermission
+	}
+	_, err = trashManager.Trash(p, d.user)
+	return err
+}
+
+// Rename moves oldName to newName, copying when they are on different
+// filesystems. The WebDAV handler has already removed newName if it was to
+// be overwritten.
+func (d *davFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	src, err := d.resolve(oldName, false)
+	if err != nil {
+		return err
+	}
+	dst, err := d.resolve(newName, true)
+	if err != nil {
+		return err
+	}
+	if src == "" || dst == "" || storage.IsRoot(src) {
+		return os.ErrPermission
+	}
+	if isWithin(src, dst) {
+		return os.ErrInvalid
+	}
+	if !aclManager.AllowedTree(d.user, src, ACLDelete) {
+		return os.ErrPermission
+	}
+	if err := d.allow(filepath.Dir(dst), ACLWrite); err != nil {
+		return err
+	}
+	if err := transferEntry(ctx, &Job{}, "move", src, dst, false); err != nil {
+		return err
+	}
+	if err := quotaManager.Move(src, dst); err != nil {
+		return err
+	}
+	return aclManager.Move(src, dst)
+}
+
+func (d *davFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	p, err := d.resolve(name, true)
+	if err != nil {
+		return nil, err
+	}
+	if p == "" {
+		return davDirInfo{name: "/", modTime: time.Now()}, nil
+	}
+	if err := d.allow(p, ACLRead); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	return davFileInfo{info}, nil
+}
+
+// davFile hides the trash, in-progress temporary files and folders user
+// may not read from listings. Files opened for writing cannot grow past
+// owner's hard quota and are charged to owner when closed.
+type davFile struct {
+	*os.File
+	path  string
+	user  *User
+	owner string
+	// part is the temporary file written in place of path, if any
+	part string
+	// size is the file's size so far when opened for writing
+	size       int64
+	fileSystem *davFileSystem
+	// failed is the first error writing to the file
+	failed error
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	if f.owner != "" {
+		offset, err := f.File.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		size := max(f.size, offset+int64(len(p)))
+		if size > f.fileSystem.reserved {
+			var exceeded *QuotaExceededError
+			if _, err := quotaManager.Reserve(f.fileSystem.reservation, f.owner, f.path, size); errors.As(err, &exceeded) {
+				f.fileSystem.exceeded = exceeded
+				return 0, err
+			}
+			f.fileSystem.reserved = size
+		}
+		f.size = size
+	}
+	n, err := f.File.Write(p)
+	if err != nil && f.failed == nil {
+		f.failed = err
+	}
+	return n, err
+}
+
+// ReadFrom hides os.File's, which io.Copy would use to bypass Write. It
+// also notes bodies that break off, which the WebDAV handler still closes.
+func (f *davFile) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(struct{ io.Writer }{f}, r)
+	if err != nil && f.failed == nil {
+		f.failed = err
+	}
+	return n, err
+}
+
+func (f *davFile) Close() error {
+	err := f.File.Close()
+	if f.owner == "" {
+		return err
+	}
+	if err == nil && f.fileSystem.exceeded != nil {
+		err = f.fileSystem.exceeded
+	}
+	if err == nil {
+		err = f.failed
+	}
+
+	// Nothing of a failed write, or one refused for its quota, is kept
+	if f.part != "" {
+		if err != nil {
+			os.Remove(f.part)
+			return err
+		}
+		if err = f.replace(); err != nil {
+			os.Remove(f.part)
+			return err
+		}
+	}
+	if err == nil {
+		chargeFile(f.path, f.owner)
+	}
+	return err
+}
+
+// replace moves the finished temporary file over path, keeping the file
+// it replaces as a version
+func (f *davFile) replace() error {
+	if info, err := os.Lstat(f.path); err == nil && info.Mode().IsRegular() {
+		if err := versionManager.Snapshot(f.path, f.owner); err != nil {
+			return err
+		}
+	}
+	return os.Rename(f.part, f.path)
+}
+
+func (f *davFile) Readdir(count int) ([]fs.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	visible := infos[:0]
+	for _, info := range infos {
+		full := filepath.Join(f.path, info.Name())
+		if storage.IsReserved(full) || isTemporaryName(info.Name()) {
+			continue
+		}
+		if info.IsDir() && !aclManager.Allowed(f.user, full, ACLRead) {
+			continue
+		}
+		visible = append(visible, davFileInfo{info})
+	}
+	return visible, err
+}
+
+func (f *davFile) Stat() (fs.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return davFileInfo{info}, nil
+}
+
+// davFileInfo reports content types from the type registry so that
+// listings do not have to read every file
+type davFileInfo struct {
+	fs.FileInfo
+}
+
+func (info davFileInfo) ContentType(ctx context.Context) (string, error) {
+	mimeType := getMimeType(info.Name())
+	if mimeType == "application/octet-stream" {
+		return "", webdav.ErrNotImplemented
+	}
+	return mimeType, nil
+}
+
+// davRootDir is the read-only collection listing the volumes
+type davRootDir struct {
+	read bool
+}
+
+func (r *davRootDir) Readdir(count int) ([]fs.FileInfo, error) {
+	if r.read {
+		if count > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	r.read = true
+
+	var infos []fs.FileInfo
+	for _, root := range storage.Roots() {
+		info, err := os.Stat(root.Path)
+		if err != nil {
+			continue
+		}
+		infos = append(infos, davDirInfo{name: root.Name, modTime: info.ModTime()})
+	}
+	return infos, nil
+}
+
+func (r *davRootDir) Stat() (fs.FileInfo, error) {
+	return davDirInfo{name: "/", modTime: time.Now()}, nil
+}
+
+func (r *davRootDir) Close() error                                 { return nil }
+func (r *davRootDir) Read(p []byte) (int, error)                   { return 0, os.ErrInvalid }
+func (r *davRootDir) Seek(offset int64, whence int) (int64, error) { return 0, os.ErrInvalid }
+func (r *davRootDir) Write(p []byte) (int, error)                  { return 0, os.ErrPermission }
+
+// davDirInfo describes the virtual root and the volumes inside it
+type davDirInfo struct {
+	name    string
+	modTime time.Time
+}
+
+func (i davDirInfo) Name() string       { return i.name }
+func (i davDirInfo) Size() int64        { return 0 }
+func (i davDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (i davDirInfo) ModTime() time.Time { return i.modTime }
+func (i davDirInfo) IsDir() bool        { return true }
+func (i davDirInfo) Sys() any           { return nil }
@@ -4,6 +4,9 @@ import (
 	"log"
 	"nas-os/backend/handlers"
 	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -12,6 +15,7 @@ import (
 	"github.com/shirou/gopsutil/v3/disk"
 	"github.com/shirou/gopsutil/v3/host"
 	"github.com/shirou/gopsutil/v3/mem"
+	bolt "go.etcd.io/bbolt"
 )
 
 type SystemInfo struct {
@@ -52,14 +56,177 @@ type HostInfo struct {
 }
 
 func main() {
+	// Persistent storage
+	dataDir := getEnv("NAS_DATA_DIR", "./data")
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		log.Fatalf("Cannot create data directory: %v", err)
+	}
+
+	db, err := bolt.Open(filepath.Join(dataDir, "nas-os.db"), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		log.Fatalf("Cannot open database: %v", err)
+	}
+	defer db.Close()
+
+	userStore, err := handlers.NewBoltUserStore(db)
+	if err != nil {
+		log.Fatalf("Cannot initialize user store: %v", err)
+	}
+	if err := handlers.EnsureDefaultAdmin(userStore); err != nil {
+		log.Fatalf("Cannot create default admin: %v", err)
+	}
+	handlers.SetUserStore(userStore)
+
+	sessionManager, err := handlers.NewSessionManager(db, 24*time.Hour, 7*24*time.Hour)
+	if err != nil {
+		log.Fatalf("Cannot initialize session manager: %v", err)
+	}
+	stopReaper := sessionManager.StartReaper(time.Minute)
+	defer stopReaper()
+	handlers.SetSessionManager(sessionManager)
+
+	roleManager, err := handlers.NewRoleManager(db)
+	if err != nil {
+		log.Fatalf("Cannot initialize role manager: %v", err)
+	}
+	handlers.SetRoleManager(roleManager)
+
+	groupManager, err := handlers.NewGroupManager(db)
+	if err != nil {
+		log.Fatalf("Cannot initialize group manager: %v", err)
+	}
+	handlers.SetGroupManager(groupManager)
+
+	apiTokenStore, err := handlers.NewAPITokenStore(db)
+	if err != nil {
+		log.Fatalf("Cannot initialize API token store: %v", err)
+	}
+	handlers.SetAPITokenStore(apiTokenStore)
+
+	loginLimiter := handlers.NewLoginLimiter(
+		handlers.LockoutPolicy{FreeAttempts: 5, BaseDelay: 30 * time.Second, MaxDelay: time.Hour, ResetAfter: time.Hour},
+		handlers.LockoutPolicy{FreeAttempts: 20, BaseDelay: 30 * time.Second, MaxDelay: time.Hour, ResetAfter: time.Hour},
+	)
+	stopLimiterReaper := loginLimiter.StartReaper(10 * time.Minute)
+	defer stopLimiterReaper()
+	handlers.SetLoginLimiter(loginLimiter)
+
+	resetLimiter := handlers.NewLoginLimiter(
+		handlers.LockoutPolicy{FreeAttempts: 3, BaseDelay: 15 * time.Minute, MaxDelay: 24 * time.Hour, ResetAfter: 24 * time.Hour},
+		handlers.LockoutPolicy{FreeAttempts: 10, BaseDelay: 5 * time.Minute, MaxDelay: time.Hour, ResetAfter: time.Hour},
+	)
+	stopResetLimiterReaper := resetLimiter.StartReaper(10 * time.Minute)
+	defer stopResetLimiterReaper()
+	handlers.SetResetLimiter(resetLimiter)
+
+	sharePolicy := handlers.LockoutPolicy{FreeAttempts: 5, BaseDelay: 30 * time.Second, MaxDelay: time.Hour, ResetAfter: time.Hour}
+	shareLimiter := handlers.NewLoginLimiter(sharePolicy, sharePolicy)
+	stopShareLimiterReaper := shareLimiter.StartReaper(10 * time.Minute)
+	defer stopShareLimiterReaper()
+	handlers.SetShareLimiter(shareLimiter)
+
+	handlers.SetMailer(loadMailer())
+
+	resetStore, err := handlers.NewPasswordResetStore(db, getEnv("NAS_PASSWORD_RESET_URL", "http://localhost:5173/reset-password"))
+	if err != nil {
+		log.Fatalf("Cannot initialize password reset store: %v", err)
+	}
+	handlers.SetPasswordResetStore(resetStore)
+
+	storage, err := handlers.NewStorageResolver(loadStorageRoots())
+	if err != nil {
+		log.Fatalf("Cannot initialize storage volumes: %v", err)
+	}
+	handlers.SetStorageResolver(storage)
+
+	quotaManager, err := handlers.NewQuotaManager(db)
+	if err != nil {
+		log.Fatalf("Cannot initialize quotas: %v", err)
+	}
+	handlers.SetQuotaManager(quotaManager)
+
+	aclManager, err := handlers.NewACLManager(db)
+	if err != nil {
+		log.Fatalf("Cannot initialize folder ACLs: %v", err)
+	}
+	handlers.SetACLManager(aclManager)
+
+	uploadManager, err := handlers.NewUploadManager(db, filepath.Join(dataDir, "uploads"))
+	if err != nil {
+		log.Fatalf("Cannot initialize upload manager: %v", err)
+	}
+	stopUploadReaper := uploadManager.StartReaper(time.Hour)
+	defer stopUploadReaper()
+	handlers.SetUploadManager(uploadManager)
+
+	jobManager := handlers.NewJobManager(2, time.Hour)
+	stopJobReaper := jobManager.StartReaper(10 * time.Minute)
+	defer stopJobReaper()
+	handlers.SetJobManager(jobManager)
+
+	trashManager, err := handlers.NewTrashManager(db, loadTrashPolicy())
+	if err != nil {
+		log.Fatalf("Cannot initialize trash: %v", err)
+	}
+	stopTrashReaper := trashManager.StartReaper(time.Hour)
+	defer stopTrashReaper()
+	handlers.SetTrashManager(trashManager)
+
+	versionManager, err := handlers.NewVersionManager(db, loadVersionPolicy())
+	if err != nil {
+		log.Fatalf("Cannot initialize file versions: %v", err)
+	}
+	stopVersionReaper := versionManager.StartReaper(time.Hour)
+	defer stopVersionReaper()
+	handlers.SetVersionManager(versionManager)
+
+	searchIndex, err := handlers.NewSearchIndex(db)
+	if err != nil {
+		log.Fatalf("Cannot load search index: %v", err)
+	}
+	stopIndexer, err := searchIndex.Start()
+	if err != nil {
+		log.Fatalf("Cannot start search indexer: %v", err)
+	}
+	defer stopIndexer()
+	handlers.SetSearchIndex(searchIndex)
+
+	thumbnailService, err := handlers.NewThumbnailService(filepath.Join(dataDir, "thumbnails"), loadThumbnailCacheSize(), min(runtime.NumCPU(), 4))
+	if err != nil {
+		log.Fatalf("Cannot initialize thumbnail cache: %v", err)
+	}
+	handlers.SetThumbnailService(thumbnailService)
+
+	shareManager, err := handlers.NewShareManager(db, getEnv("NAS_SHARE_URL", "http://localhost:8080/s"))
+	if err != nil {
+		log.Fatalf("Cannot initialize share links: %v", err)
+	}
+	handlers.SetShareManager(shareManager)
+
+	if ldapConfig, ok := loadLDAPConfig(); ok {
+		handlers.SetLDAPAuthenticator(handlers.NewLDAPAuthenticator(ldapConfig))
+		log.Printf("LDAP authentication enabled via %s", ldapConfig.URL)
+	}
+
+	if oidcConfig, ok := loadOIDCConfig(); ok {
+		handlers.SetOIDCProvider(handlers.NewOIDCProvider(oidcConfig))
+		log.Printf("OpenID Connect login enabled via %s", oidcConfig.Issuer)
+	}
+
 	r := gin.Default()
 
+	// Client addresses key the login limiter, so X-Forwarded-For is only
+	// believed when it comes from a configured proxy
+	if err := r.SetTrustedProxies(loadTrustedProxies()); err != nil {
+		log.Fatalf("Invalid NAS_TRUSTED_PROXIES: %v", err)
+	}
+
 	// CORS middleware
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"http://localhost:3000", "http://localhost:5173"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", "Tus-Resumable", "Upload-Length", "Upload-Metadata", "Upload-Offset", "Upload-Checksum", "X-Share-Grant"},
+		ExposeHeaders:    []string{"Content-Length", "X-Quota-Warning", "Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Checksum-Algorithm", "Upload-Offset", "Upload-Length", "Upload-Expires"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
@@ -71,43 +238,194 @@ func main() {
 		auth := api.Group("/auth")
 		{
 			auth.POST("/login", handlers.Login)
+			auth.POST("/login/verify", handlers.VerifyLogin)
 			auth.POST("/logout", handlers.Logout)
+			auth.POST("/password/forgot", handlers.ForgotPassword)
+			auth.POST("/password/reset", handlers.ResetPassword)
+			auth.GET("/oidc/login", handlers.OIDCLogin)
+			auth.GET("/oidc/callback", handlers.OIDCCallback)
 		}
 
 		// Protected routes (require authentication)
 		protected := api.Group("/")
 		protected.Use(handlers.AuthMiddleware())
 		{
-			// User management
 			protected.GET("/user", handlers.GetCurrentUser)
-			protected.GET("/users", handlers.GetUsers)
-			protected.POST("/users", handlers.CreateUser)
-			protected.DELETE("/users/:username", handlers.DeleteUser)
+			protected.GET("/health", healthCheck)
+
+			// Credentials; a scoped token must not be able to widen itself
+			credentials := protected.Group("/", handlers.RejectScopedTokens())
+			{
+				credentials.PUT("/user", handlers.UpdateCurrentUser)
+				credentials.POST("/user/password", handlers.ChangePassword)
+				credentials.POST("/user/2fa/setup", handlers.SetupTwoFactor)
+				credentials.POST("/user/2fa/enable", handlers.EnableTwoFactor)
+				credentials.POST("/user/2fa/disable", handlers.DisableTwoFactor)
+				credentials.POST("/user/2fa/recovery-codes", handlers.RegenerateRecoveryCodes)
+			}
+
+			// Session management
+			protected.GET("/sessions", handlers.GetSessions)
+			protected.DELETE("/sessions/:id", handlers.RevokeSession)
+
+			// API tokens (owners manage their own, admins may list and revoke)
+			tokens := protected.Group("/users/:username/tokens", handlers.RejectScopedTokens())
+			{
+				tokens.GET("", handlers.GetAPITokens)
+				tokens.POST("", handlers.CreateAPIToken)
+				tokens.DELETE("/:id", handlers.RevokeAPIToken)
+			}
+
+			// User management
+			users := protected.Group("/users", handlers.RequirePermission(handlers.PermUsersAdmin))
+			{
+				users.GET("", handlers.GetUsers)
+				users.POST("", handlers.CreateUser)
+				users.PUT("/:username", handlers.UpdateUser)
+				users.DELETE("/:username", handlers.DeleteUser)
+				users.DELETE("/:username/2fa", handlers.ResetUserTwoFactor)
+			}
+
+			// Group management
+			groups := protected.Group("/groups", handlers.RequirePermission(handlers.PermUsersAdmin))
+			{
+				groups.GET("", handlers.GetGroups)
+				groups.POST("", handlers.CreateGroup)
+				groups.GET("/:name", handlers.GetGroup)
+				groups.PUT("/:name", handlers.UpdateGroup)
+				groups.DELETE("/:name", handlers.DeleteGroup)
+				groups.POST("/:name/members", handlers.AddGroupMember)
+				groups.DELETE("/:name/members/:username", handlers.RemoveGroupMember)
+			}
+
+			// Login lockouts
+			lockouts := protected.Group("/lockouts", handlers.RequirePermission(handlers.PermUsersAdmin))
+			{
+				lockouts.GET("", handlers.GetLockouts)
+				lockouts.DELETE("", handlers.UnlockLockout)
+			}
+
+			// Storage quotas
+			protected.GET("/quotas", handlers.GetQuotas)
+			quotas := protected.Group("/quotas", handlers.RequirePermission(handlers.PermUsersAdmin))
+			{
+				quotas.PUT("", handlers.SetQuota)
+				quotas.DELETE("", handlers.DeleteQuota)
+			}
+
+			// Folder access control lists
+			acls := protected.Group("/acls", handlers.RequirePermission(handlers.PermUsersAdmin))
+			{
+				acls.GET("", handlers.GetACLs)
+				acls.PUT("", handlers.SetACL)
+				acls.DELETE("", handlers.DeleteACL)
+			}
+
+			// Role management
+			roles := protected.Group("/", handlers.RequirePermission(handlers.PermRolesAdmin))
+			{
+				roles.GET("/permissions", handlers.GetPermissions)
+				roles.GET("/roles", handlers.GetRoles)
+				roles.POST("/roles", handlers.CreateRole)
+				roles.PUT("/roles/:name", handlers.UpdateRole)
+				roles.DELETE("/roles/:name", handlers.DeleteRole)
+			}
 
 			// System monitoring
-			protected.GET("/system", getSystemInfo)
-			protected.GET("/health", healthCheck)
+			protected.GET("/system", handlers.RequirePermission(handlers.PermSystemRead), getSystemInfo)
 
 			// File management
-			protected.GET("/files", handlers.GetFiles)
-			protected.POST("/files/upload", handlers.UploadFile)
-			protected.GET("/files/download", handlers.DownloadFile)
-			protected.DELETE("/files", handlers.DeleteFile)
-			protected.POST("/files/folder", handlers.CreateFolder)
+			filesRead := protected.Group("/files", handlers.RequirePermission(handlers.PermFilesRead))
+			{
+				filesRead.GET("", handlers.GetFiles)
+				filesRead.GET("/roots", handlers.GetStorageRoots)
+				filesRead.GET("/download", handlers.DownloadFile)
+				filesRead.HEAD("/download", handlers.DownloadFile)
+				filesRead.POST("/archive", handlers.DownloadArchive)
+				filesRead.GET("/search", handlers.SearchFiles)
+				filesRead.GET("/thumbnail", handlers.GetThumbnail)
+				filesRead.GET("/acl", handlers.GetFolderACL)
+				filesRead.GET("/versions", handlers.GetVersions)
+				filesRead.GET("/versions/:id/download", handlers.DownloadVersion)
+
+				// Public share links
+				filesRead.GET("/shares", handlers.GetShares)
+				filesRead.POST("/shares", handlers.CreateShare)
+				filesRead.DELETE("/shares/:token", handlers.DeleteShare)
+				filesRead.GET("/shares/:token/access", handlers.GetShareAccessLog)
+			}
+			filesWrite := protected.Group("/files", handlers.RequirePermission(handlers.PermFilesWrite))
+			{
+				filesWrite.POST("/upload", handlers.UploadFile)
+				filesWrite.DELETE("", handlers.DeleteFile)
+				filesWrite.POST("/folder", handlers.CreateFolder)
+				filesWrite.POST("/rename", handlers.RenameFile)
+				filesWrite.POST("/move", handlers.MoveFiles)
+				filesWrite.POST("/copy", handlers.CopyFiles)
+
+				// Recycle bin
+				filesWrite.GET("/trash", handlers.GetTrash)
+				filesWrite.POST("/trash/:id/restore", handlers.RestoreTrashItem)
+				filesWrite.DELETE("/trash/:id", handlers.PurgeTrashItem)
+				filesWrite.DELETE("/trash", handlers.EmptyTrash)
+
+				// Earlier versions of overwritten files
+				filesWrite.POST("/versions/:id/restore", handlers.RestoreVersion)
+				filesWrite.DELETE("/versions/:id", handlers.DeleteVersion)
+
+				// Background jobs started by move and copy
+				filesWrite.GET("/jobs", handlers.GetJobs)
+				filesWrite.GET("/jobs/:id", handlers.GetJob)
+				filesWrite.DELETE("/jobs/:id", handlers.CancelJob)
+
+				// Resumable uploads (tus 1.0)
+				uploads := filesWrite.Group("/uploads", handlers.TusResumable())
+				{
+					uploads.OPTIONS("", handlers.TusOptions)
+					uploads.POST("", handlers.CreateUpload)
+					uploads.HEAD("/:id", handlers.HeadUpload)
+					uploads.PATCH("/:id", handlers.PatchUpload)
+					uploads.DELETE("/:id", handlers.DeleteUpload)
+				}
+			}
 
 			// Samba routes
-			protected.GET("/samba/shares", handlers.GetSambaShares)
-			protected.POST("/samba/shares", handlers.CreateSambaShare)
-			protected.DELETE("/samba/shares/:name", handlers.DeleteSambaShare)
-			protected.POST("/samba/start", handlers.StartSambaService)
-			protected.POST("/samba/stop", handlers.StopSambaService)
-			protected.GET("/samba/status", handlers.GetSambaStatus)
+			sambaRead := protected.Group("/samba", handlers.RequirePermission(handlers.PermSambaRead))
+			{
+				sambaRead.GET("/shares", handlers.GetSambaShares)
+				sambaRead.GET("/status", handlers.GetSambaStatus)
+			}
+			sambaAdmin := protected.Group("/samba", handlers.RequirePermission(handlers.PermSambaAdmin))
+			{
+				sambaAdmin.POST("/shares", handlers.CreateSambaShare)
+				sambaAdmin.DELETE("/shares/:name", handlers.DeleteSambaShare)
+				sambaAdmin.POST("/start", handlers.StartSambaService)
+				sambaAdmin.POST("/stop", handlers.StopSambaService)
+			}
 
 			// Network management
-			protected.GET("/network", handlers.GetNetworkConfig)
+			protected.GET("/network", handlers.RequirePermission(handlers.PermNetworkRead), handlers.GetNetworkConfig)
 		}
 	}
 
+	// WebDAV access to the storage volumes, signed in with an API token as
+	// the Basic auth password
+	dav := r.Group("/dav", handlers.DAVBasicAuth(), handlers.AuthMiddleware())
+	davHandler := handlers.WebDAVHandler("/dav")
+	for _, method := range handlers.DAVMethods {
+		dav.Handle(method, "/*path", davHandler)
+	}
+
+	// Public share links (no authentication)
+	shares := r.Group("/s/:token", handlers.ShareAccessLogger())
+	{
+		shares.GET("", handlers.GetPublicShare)
+		shares.POST("/unlock", handlers.UnlockPublicShare)
+		shares.GET("/download", handlers.DownloadPublicShare)
+		shares.HEAD("/download", handlers.DownloadPublicShare)
+		shares.POST("/upload", handlers.UploadPublicShare)
+	}
+
 	log.Println("🚀 NAS OS Backend starting on :8080")
 	r.Run(":8080")
 }
@@ -186,4 +504,4 @@ func healthCheck(c *gin.Context) {
 		"timestamp": time.Now().Unix(),
 		"service":   "nas-os-backend",
 	})
-}
\ No newline at end of file
+}